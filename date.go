@@ -0,0 +1,204 @@
+package borat
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Date is a calendar date without a time of day or time zone. It is encoded
+// as a full-date string with tag 1004 or as a number of days since the epoch
+// with tag 100, as defined in RFC 8943.
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// DateOf returns the date on which t falls in t's location.
+func DateOf(t time.Time) Date {
+	y, m, d := t.Date()
+	return Date{Year: y, Month: m, Day: d}
+}
+
+// ParseDate parses an RFC 3339 full-date such as 2006-01-02.
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return Date{}, err
+	}
+	return DateOf(t), nil
+}
+
+// String returns the date in RFC 3339 full-date format.
+func (d Date) String() string {
+	return d.In(time.UTC).Format(dateLayout)
+}
+
+// In returns the time at midnight at the start of the date in loc.
+func (d Date) In(loc *time.Location) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, loc)
+}
+
+const dateLayout = "2006-01-02"
+
+const secondsPerDay = 24 * 60 * 60
+
+// daysSinceEpoch returns the number of days between 1970-01-01 and d.
+func (d Date) daysSinceEpoch() int64 {
+	return d.In(time.UTC).Unix() / secondsPerDay
+}
+
+// maxDays bounds the number of days dateFromDays accepts, leaving room for
+// the offset time.Time adds to Unix times.
+const maxDays = math.MaxInt64 / secondsPerDay / 2
+
+// dateFromDays returns the date a number of days after 1970-01-01.
+func dateFromDays(days int64) (Date, error) {
+	if days > maxDays || days < -maxDays {
+		return Date{}, fmt.Errorf("%d days since the epoch is out of range", days)
+	}
+	return DateOf(time.Unix(days*secondsPerDay, 0).UTC()), nil
+}
+
+// dateFromElement converts a value returned by Read into a date. Untagged
+// strings are read as full-dates.
+func dateFromElement(elem TaggedElement) (Date, error) {
+	switch v := elem.Value.(type) {
+	case string:
+		if elem.Tag == TagDateString || elem.Tag == CBORTag(0) {
+			return ParseDate(v)
+		}
+	case int:
+		if elem.Tag == TagDateEpochDays {
+			return dateFromDays(int64(v))
+		}
+	}
+	return Date{}, fmt.Errorf("cannot convert %T with tag %d to a date", elem.Value, elem.Tag)
+}
+
+// Keys of an extended time map with tag 1001, from RFC 9581.
+const (
+	extTimeBase     = 1
+	extTimeScale    = -1
+	extTimeMilli    = -3
+	extTimeMicro    = -6
+	extTimeNano     = -9
+	extTimeZoneHint = -10
+	extTimePico     = -12
+)
+
+// extendedTimeMap returns the content of an extended time tag for t: the
+// seconds since the epoch, nanoseconds if there are any, and a hint of the
+// time zone unless t is in UTC.
+func extendedTimeMap(t time.Time) map[int]interface{} {
+	m := map[int]interface{}{extTimeBase: int(t.Unix())}
+	if ns := t.Nanosecond(); ns != 0 {
+		m[extTimeNano] = ns
+	}
+	if loc := t.Location(); loc != time.UTC {
+		if name := loc.String(); loc != time.Local && isZoneName(name) {
+			m[extTimeZoneHint] = name
+		} else {
+			_, offset := t.Zone()
+			m[extTimeZoneHint] = offset
+		}
+	}
+	return m
+}
+
+// isZoneName reports whether name is a zone in the IANA Time Zone Database.
+func isZoneName(name string) bool {
+	if name == "" || name == "UTC" {
+		return false
+	}
+	return loadZone(name) != nil
+}
+
+// zones caches the locations loaded by loadZone. Names that fail to load are
+// not cached, as they may come from untrusted input.
+var zones sync.Map
+
+// loadZone returns the location with the given name, or nil if there is no
+// such location. Loading a location reads the time zone database, so results
+// are cached.
+func loadZone(name string) *time.Location {
+	if loc, ok := zones.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	zones.Store(name, loc)
+	return loc
+}
+
+// timeFromExtended converts the content of an extended time tag into a time.
+// Unknown elective (positive) keys are ignored, unknown critical (negative)
+// keys are an error. Precision beyond nanoseconds is dropped.
+func timeFromExtended(m map[int]TaggedElement) (time.Time, error) {
+	base, ok := m[extTimeBase]
+	if !ok {
+		return time.Time{}, fmt.Errorf("extended time has no base time")
+	}
+	t, err := timeFromElement(TaggedElement{Tag: TagDateTimeEpoch, Value: base.Value})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fractions := 0
+	for k, e := range m {
+		// fractions of a second, as units below one second
+		var units int64
+		switch k {
+		case extTimeBase:
+			continue
+		case extTimeScale:
+			if e.Value != 0 {
+				return time.Time{}, fmt.Errorf("unsupported time scale %v", e.Value)
+			}
+			continue
+		case extTimeZoneHint:
+			switch hint := e.Value.(type) {
+			case string:
+				if loc := loadZone(hint); loc != nil {
+					t = t.In(loc)
+				}
+			case int:
+				t = t.In(time.FixedZone("", hint))
+			default:
+				return time.Time{}, fmt.Errorf("invalid time zone hint %v", e.Value)
+			}
+			continue
+		case extTimeMilli:
+			units = 1e3
+		case extTimeMicro:
+			units = 1e6
+		case extTimeNano:
+			units = 1e9
+		case extTimePico:
+			units = 1e12
+		default:
+			if k < 0 {
+				return time.Time{}, fmt.Errorf("unsupported critical extended time key %d", k)
+			}
+			continue
+		}
+
+		if fractions++; fractions > 1 {
+			return time.Time{}, fmt.Errorf("extended time has more than one fraction of a second")
+		}
+		frac, ok := e.Value.(int)
+		if !ok || frac < 0 || int64(frac) >= units {
+			return time.Time{}, fmt.Errorf("invalid fraction of a second %v for key %d", e.Value, k)
+		}
+		if units <= 1e9 {
+			t = t.Add(time.Duration(int64(frac) * (1e9 / units)))
+		} else {
+			t = t.Add(time.Duration(int64(frac) / (units / 1e9)))
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,77 @@
+package borat
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Decimal is a decimal fraction with the value Mantissa * 10^Exponent. It is
+// encoded with tag 4, and allows exchanging decimal numbers such as prices
+// without the rounding of binary floats.
+type Decimal struct {
+	Mantissa *big.Int
+	Exponent int
+}
+
+// String returns the decimal in scientific notation, e.g. 27315e-2.
+func (d Decimal) String() string {
+	m := d.Mantissa
+	if m == nil {
+		m = new(big.Int)
+	}
+	if d.Exponent == 0 {
+		return m.String()
+	}
+	return fmt.Sprintf("%se%d", m, d.Exponent)
+}
+
+// bigFloatMantExp returns f as an integer mantissa and a binary exponent.
+func bigFloatMantExp(f *big.Float) (*big.Int, int, error) {
+	if f.IsInf() {
+		return nil, 0, fmt.Errorf("cannot encode infinite big.Float")
+	}
+	if f.Sign() == 0 {
+		return new(big.Int), 0, nil
+	}
+	// f = mant * 2^exp with 0.5 <= |mant| < 1, so mant * 2^prec is an
+	// integer for the minimal precision prec
+	mant := new(big.Float)
+	exp := f.MantExp(mant)
+	prec := int(f.MinPrec())
+	mant.SetMantExp(mant, prec)
+	m, _ := mant.Int(nil)
+	return m, exp - prec, nil
+}
+
+// newBigFloat returns m * 2^exp without loss of precision. As with
+// big.Float.SetInt, the precision is at least 64 bits.
+func newBigFloat(m *big.Int, exp int) *big.Float {
+	f := new(big.Float).SetInt(m)
+	return f.SetMantExp(f, exp)
+}
+
+// mantExpFromElement converts a value returned by Read and tagged with tag
+// into a mantissa and exponent. Plain integers have an exponent of zero.
+func mantExpFromElement(elem TaggedElement, tag CBORTag) (*big.Int, int, error) {
+	if elem.Tag != tag {
+		if isIntegerValue(elem.Value) {
+			m, err := bigIntFromElement(elem)
+			return m, 0, err
+		}
+		return nil, 0, fmt.Errorf("cannot convert %T with tag %d to a tag %d number", elem.Value, elem.Tag, tag)
+	}
+
+	a, ok := elem.Value.([]TaggedElement)
+	if !ok || len(a) != 2 || a[0].Tag != CBORTag(0) {
+		return nil, 0, fmt.Errorf("tag %d content is not an [exponent, mantissa] array", tag)
+	}
+	exp, ok := a[0].Value.(int)
+	if !ok {
+		return nil, 0, fmt.Errorf("tag %d exponent %v is not an int", tag, a[0].Value)
+	}
+	m, err := bigIntFromElement(a[1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, exp, nil
+}
@@ -0,0 +1,83 @@
+package borat
+
+import "math"
+
+// float16ToFloat64 expands an IEEE 754 half-precision number, as found in
+// CBOR major type 7 with additional information 25.
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		// zero and subnormals
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// float64ToFloat32 returns f as a single-precision number, and whether the
+// conversion is exact.
+func float64ToFloat32(f float64) (float32, bool) {
+	f32 := float32(f)
+	return f32, float64(f32) == f || math.IsNaN(f)
+}
+
+// float64ToFloat16 returns f as a half-precision number, and whether the
+// conversion is exact. All NaNs map to the canonical quiet NaN.
+func float64ToFloat16(f float64) (uint16, bool) {
+	if math.IsNaN(f) {
+		return 0x7e00, true
+	}
+	f32, ok := float64ToFloat32(f)
+	if !ok {
+		return 0, false
+	}
+
+	bits := math.Float32bits(f32)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+
+	switch {
+	case exp == 0xff:
+		// infinity
+		return sign | 0x7c00, true
+	case exp == 0:
+		// zero, or a single-precision subnormal far below the half range
+		return sign, mant == 0
+	}
+
+	e := exp - 127
+	switch {
+	case e > 15 || e < -24:
+		return 0, false
+	case e >= -14:
+		// normal half-precision number: the 13 lowest mantissa bits are lost
+		if mant&0x1fff != 0 {
+			return 0, false
+		}
+		return sign | uint16(e+15)<<10 | uint16(mant>>13), true
+	default:
+		// subnormal half-precision number
+		full := mant | 0x800000
+		shift := uint(-1 - e)
+		if full&(1<<shift-1) != 0 {
+			return 0, false
+		}
+		return sign | uint16(full>>shift), true
+	}
+}
@@ -0,0 +1,150 @@
+package borat
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// addrTag returns the RFC 9164 tag for addresses of the family of a.
+func addrTag(a netip.Addr) CBORTag {
+	if a.Is4() {
+		return TagIPv4
+	}
+	return TagIPv6
+}
+
+// addrBytes returns the content of an address tag for a.
+func addrBytes(a netip.Addr) ([]byte, error) {
+	if !a.IsValid() {
+		return nil, fmt.Errorf("cannot encode invalid IP address")
+	}
+	if a.Zone() != "" {
+		return nil, fmt.Errorf("cannot encode IP address %v with zone", a)
+	}
+	return a.AsSlice(), nil
+}
+
+// prefixBytes returns the address of a prefix in the compact form of RFC
+// 9164: only the bytes covered by the prefix length, without trailing zero
+// bytes.
+func prefixBytes(p netip.Prefix) []byte {
+	b := p.Masked().Addr().AsSlice()
+	b = b[:(p.Bits()+7)/8]
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// addrFromElement converts a value returned by Read into an address.
+// Untagged byte strings are accepted as well, and hold an IPv4 or an IPv6
+// address depending on their length.
+func addrFromElement(elem TaggedElement) (netip.Addr, error) {
+	b, ok := elem.Value.([]byte)
+	if !ok || (elem.Tag != TagIPv4 && elem.Tag != TagIPv6 && elem.Tag != CBORTag(0)) {
+		return netip.Addr{}, fmt.Errorf("%w %d: cannot convert %T to an IP address", TagContentError, elem.Tag, elem.Value)
+	}
+	switch {
+	case elem.Tag != TagIPv6 && len(b) == net.IPv4len:
+		return netip.AddrFrom4([4]byte(b)), nil
+	case elem.Tag != TagIPv4 && len(b) == net.IPv6len:
+		return netip.AddrFrom16([16]byte(b)), nil
+	}
+	return netip.Addr{}, fmt.Errorf("%w %d: IP address has %d bytes", TagContentError, elem.Tag, len(b))
+}
+
+// prefixFromElement converts a value returned by Read into a prefix. Both the
+// prefix form [length, address bytes] and the interface form [address,
+// length] are accepted; only the latter may have bits set beyond the prefix
+// length.
+func prefixFromElement(elem TaggedElement) (netip.Prefix, error) {
+	a, ok := elem.Value.([]TaggedElement)
+	if !ok || len(a) != 2 || (elem.Tag != TagIPv4 && elem.Tag != TagIPv6) {
+		return netip.Prefix{}, fmt.Errorf("%w %d: cannot convert %T to an IP prefix", TagContentError, elem.Tag, elem.Value)
+	}
+
+	// interface form: a full address followed by the prefix length
+	if bits, ok := a[1].Value.(int); ok {
+		addr, err := addrFromElement(TaggedElement{Tag: elem.Tag, Value: a[0].Value})
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		p := netip.PrefixFrom(addr, bits)
+		if !p.IsValid() {
+			return netip.Prefix{}, fmt.Errorf("%w %d: invalid prefix length %d", TagContentError, elem.Tag, bits)
+		}
+		return p, nil
+	}
+
+	bits, ok := a[0].Value.(int)
+	b, ok2 := a[1].Value.([]byte)
+	if !ok || !ok2 {
+		return netip.Prefix{}, fmt.Errorf("%w %d: prefix is not a [length, bytes] array", TagContentError, elem.Tag)
+	}
+	full := make([]byte, net.IPv6len)
+	if elem.Tag == TagIPv4 {
+		full = full[:net.IPv4len]
+	}
+	if len(b) > len(full) || (len(b) > 0 && b[len(b)-1] == 0) {
+		return netip.Prefix{}, fmt.Errorf("%w %d: prefix bytes % x are not in compact form", TagContentError, elem.Tag, b)
+	}
+	copy(full, b)
+	addr, _ := netip.AddrFromSlice(full)
+	p := netip.PrefixFrom(addr, bits)
+	if !p.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("%w %d: invalid prefix length %d", TagContentError, elem.Tag, bits)
+	}
+	if p.Masked() != p {
+		return netip.Prefix{}, fmt.Errorf("%w %d: prefix %v has bits set beyond its length", TagContentError, elem.Tag, p)
+	}
+	return p, nil
+}
+
+// checkAddrContent verifies the content of tag 52 or 54, which is either an
+// address or a prefix.
+func checkAddrContent(tag CBORTag, v interface{}) error {
+	var err error
+	if _, ok := v.([]byte); ok {
+		_, err = addrFromElement(TaggedElement{Tag: tag, Value: v})
+	} else {
+		_, err = prefixFromElement(TaggedElement{Tag: tag, Value: v})
+	}
+	return err
+}
+
+// ipFromElement converts a value returned by Read into a net.IP.
+func ipFromElement(elem TaggedElement) (net.IP, error) {
+	a, err := addrFromElement(elem)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(a.AsSlice()), nil
+}
+
+// ipNetFromElement converts a value returned by Read into a net.IPNet.
+func ipNetFromElement(elem TaggedElement) (*net.IPNet, error) {
+	p, err := prefixFromElement(elem)
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPNet{
+		IP:   net.IP(p.Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}, nil
+}
+
+// prefixFromIPNet converts n to a prefix, keeping any bits set beyond the
+// prefix length.
+func prefixFromIPNet(n net.IPNet) (netip.Prefix, error) {
+	addr, ok := netip.AddrFromSlice(n.IP)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %v", n.IP)
+	}
+	addr = addr.Unmap()
+	ones, bits := n.Mask.Size()
+	if bits != addr.BitLen() {
+		return netip.Prefix{}, fmt.Errorf("invalid mask %v for %v", n.Mask, n.IP)
+	}
+	return netip.PrefixFrom(addr, ones), nil
+}
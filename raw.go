@@ -0,0 +1,30 @@
+package borat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// RawMessage is a single encoded CBOR item. It is read with the exact bytes
+// of the item as they appear in the input, and written out verbatim, so that
+// a sub-object can be forwarded or signed without decoding it. An empty
+// RawMessage is written as null.
+type RawMessage []byte
+
+// checkWellFormed verifies that b holds exactly one well-formed CBOR item,
+// nested no deeper than Validate allows.
+func checkWellFormed(b []byte) error {
+	r := NewCBORReader(bytes.NewReader(b))
+	r.SetDepthLimit(validateDepthLimit)
+	if err := r.Skip(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if r.offset != int64(len(b)) {
+		return fmt.Errorf("%d bytes of trailing data after CBOR item", int64(len(b))-r.offset)
+	}
+	return nil
+}
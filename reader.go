@@ -1,11 +1,15 @@
 package borat
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
+	"net/netip"
+	"net/url"
 	"reflect"
 	"time"
 )
@@ -16,15 +20,46 @@ var (
 	// UnsupportedTypeReadError is an explicit error for types we do not support.
 	// This is different to encountering something which is not in the RFC.
 	UnsupportedTypeReadError = errors.New("unsupported type encountered in read")
+	// MessageLimitError is returned when reading past the limit set with
+	// SetMessageLimit.
+	MessageLimitError = errors.New("message size limit exceeded")
+	// StringLimitError is returned for byte and text strings longer than the
+	// limit set with SetStringLimit.
+	StringLimitError = errors.New("string length limit exceeded")
+	// ElementLimitError is returned for arrays and maps with more items than
+	// the limit set with SetElementLimit.
+	ElementLimitError = errors.New("element count limit exceeded")
+	// DepthLimitError is returned for arrays, maps and tags nested deeper
+	// than the limit set with SetDepthLimit.
+	DepthLimitError = errors.New("nesting depth limit exceeded")
+	// IntegerOverflowError is returned when an integer does not fit into the
+	// type it is read into.
+	IntegerOverflowError = errors.New("integer overflow")
 )
 
+// maxInt is the largest length that fits into an int on this platform.
+const maxInt = uint64(^uint(0) >> 1)
+
+// readChunkSize bounds how much is allocated ahead of the data actually
+// arriving, so that a string head cannot claim more memory than is sent.
+const readChunkSize = 64 * 1024
+
 // CBORReader provides functionality to decode encoded CBOR to structures or to
 // manually read elements out of a byte slice.
 type CBORReader struct {
 	in           io.Reader
-	pushback     []byte
+	pushback     []byte // Bytes returned to the input, the next one last.
 	pushed       uint
-	messageLimit uint64 // Implement a maximum message size.
+	offset       int64  // Number of bytes consumed so far.
+	messageLimit uint64 // Maximum number of bytes to read, 0 for no limit.
+	stringLimit  uint64 // Maximum length of a byte or text string.
+	elementLimit uint64 // Maximum number of items in an array or map.
+	depthLimit   uint64 // Maximum nesting depth of arrays and maps.
+	depth        int
+	decodeBase64 bool
+	capturing    bool // Whether consumed bytes are appended to captured.
+	captured     []byte
+	scratch      [64]byte // Buffer for heads and skipped bytes.
 	regTags      map[CBORTag]reflect.Type
 }
 
@@ -36,6 +71,28 @@ func NewCBORReader(in io.Reader) *CBORReader {
 	return r
 }
 
+// RegisterTaggedStruct registers a struct which carries its own tag in a
+// cborTag member, so that the tag can be used to choose the concrete type when
+// unmarshaling into an interface.
+func (r *CBORReader) RegisterTaggedStruct(inst interface{}) error {
+	t := reflect.TypeOf(inst)
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		return fmt.Errorf("%v is not a struct", t)
+	}
+	scs := structCBORSpec{}
+	if err := scs.learnStruct(st); err != nil {
+		return err
+	}
+	if !scs.hasTag {
+		return fmt.Errorf("struct %v has no cborTag member", t)
+	}
+	return r.RegisterCBORTag(CBORTag(scs.tag), inst)
+}
+
 // RegisterCBORTag configures a mapping from a CBOR tag to a specific struct.
 func (r *CBORReader) RegisterCBORTag(tag CBORTag, inst interface{}) error {
 	if _, ok := r.regTags[tag]; ok {
@@ -45,24 +102,169 @@ func (r *CBORReader) RegisterCBORTag(tag CBORTag, inst interface{}) error {
 	return nil
 }
 
+// SetMessageLimit sets the maximum number of bytes the reader consumes from
+// its input. Reading past it returns MessageLimitError. Zero, the default,
+// means no limit.
+func (r *CBORReader) SetMessageLimit(n uint64) {
+	r.messageLimit = n
+}
+
+// SetStringLimit sets the maximum length of a byte or text string, including
+// all chunks of an indefinite-length string. Longer strings return
+// StringLimitError. Zero, the default, means no limit.
+func (r *CBORReader) SetStringLimit(n uint64) {
+	r.stringLimit = n
+}
+
+// SetElementLimit sets the maximum number of elements in an array, or of
+// key/value pairs in a map. Larger containers return ElementLimitError. Zero,
+// the default, means no limit.
+func (r *CBORReader) SetElementLimit(n uint64) {
+	r.elementLimit = n
+}
+
+// SetDepthLimit sets how deeply arrays, maps and tags may be nested, with a
+// top-level array, map or tag at depth 1. Deeper nesting returns
+// DepthLimitError. Zero, the default, means no limit.
+func (r *CBORReader) SetDepthLimit(n uint64) {
+	r.depthLimit = n
+}
+
+// SetDecodeBase64 selects whether the content of tags 33 and 34 is returned as
+// the decoded []byte rather than as the base64 string. Either way, it has to
+// be valid base64.
+func (r *CBORReader) SetDecodeBase64(decode bool) {
+	r.decodeBase64 = decode
+}
+
+// checkMessageLimit returns MessageLimitError if consuming n more bytes would
+// exceed the message limit.
+func (r *CBORReader) checkMessageLimit(n int) error {
+	if r.messageLimit > 0 && uint64(r.offset)+uint64(n) > r.messageLimit {
+		return MessageLimitError
+	}
+	return nil
+}
+
+// enter records the start of an array or map, which must be matched by a call
+// to leave once the container has been read.
+func (r *CBORReader) enter() error {
+	if r.depthLimit > 0 && uint64(r.depth) >= r.depthLimit {
+		return DepthLimitError
+	}
+	r.depth++
+	return nil
+}
+
+func (r *CBORReader) leave() {
+	r.depth--
+}
+
+// readType reads the initial byte of the next item. Self-describe tags are
+// skipped wherever they appear.
 func (r *CBORReader) readType() (byte, error) {
-	b := make([]byte, 1)
+	for {
+		b, err := r.readByte()
+		if err != nil || b != selfDescribe[0] {
+			return b, err
+		}
+
+		// look ahead for the rest of the self-describe tag
+		b1, err := r.readByte()
+		if err != nil {
+			return b, nil
+		}
+		b2, err := r.readByte()
+		if err != nil {
+			r.pushbackType(b1)
+			return b, nil
+		}
+		if b1 != selfDescribe[1] || b2 != selfDescribe[2] {
+			r.pushbackType(b2)
+			r.pushbackType(b1)
+			return b, nil
+		}
+	}
+}
+
+func (r *CBORReader) readByte() (byte, error) {
+	if err := r.checkMessageLimit(1); err != nil {
+		return 0, err
+	}
+	b := r.scratch[:1]
 	if r.pushed > 0 {
-		b[0] = r.pushback[0]
-		r.pushback = r.pushback[1:]
 		r.pushed--
+		b[0] = r.pushback[r.pushed]
+		r.pushback = r.pushback[:r.pushed]
 	} else {
 		_, err := io.ReadAtLeast(r.in, b, 1)
 		if err != nil {
 			return 0, err
 		}
 	}
+	r.offset++
+	if r.capturing {
+		r.captured = append(r.captured, b[0])
+	}
 	return b[0], nil
 }
 
+// pushbackType returns a byte to the input, to be read again before any
+// bytes pushed back earlier.
 func (r *CBORReader) pushbackType(pushback byte) {
 	r.pushback = append(r.pushback, pushback)
 	r.pushed++
+	r.offset--
+	if r.capturing && len(r.captured) > 0 {
+		r.captured = r.captured[:len(r.captured)-1]
+	}
+}
+
+// readFull reads exactly len(b) bytes, taking any pushed back bytes first.
+func (r *CBORReader) readFull(b []byte) error {
+	if err := r.checkMessageLimit(len(b)); err != nil {
+		return err
+	}
+	n := 0
+	for ; n < len(b) && r.pushed > 0; n++ {
+		r.pushed--
+		b[n] = r.pushback[r.pushed]
+	}
+	r.pushback = r.pushback[:r.pushed]
+	m, err := io.ReadFull(r.in, b[n:])
+	r.offset += int64(n + m)
+	if r.capturing {
+		r.captured = append(r.captured, b[:n+m]...)
+	}
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readBytes reads n bytes, growing the result as data arrives rather than
+// trusting n for a single allocation. n must not exceed maxInt.
+func (r *CBORReader) readBytes(n uint64) ([]byte, error) {
+	if err := r.checkMessageLimit(int(n)); err != nil {
+		return nil, err
+	}
+	if n <= readChunkSize {
+		b := make([]byte, n)
+		return b, r.readFull(b)
+	}
+	var b []byte
+	for uint64(len(b)) < n {
+		k := n - uint64(len(b))
+		if k > readChunkSize {
+			k = readChunkSize
+		}
+		start := len(b)
+		b = append(b, make([]byte, k)...)
+		if err := r.readFull(b[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
 }
 
 func (r *CBORReader) readBasicUnsigned(mt byte) (uint64, byte, bool, error) {
@@ -103,37 +305,44 @@ func (r *CBORReader) readBasicUnsigned(mt byte) (uint64, byte, bool, error) {
 		u = uint64(ct & majorMask)
 
 	case ct&majorMask == 24:
-		b := make([]byte, 1)
-		_, err := io.ReadAtLeast(r.in, b, 1)
-		if err != nil {
+		b := r.scratch[:1]
+		if err := r.readFull(b); err != nil {
 			return 0, 0, false, err
 		}
 		u = uint64(b[0])
 
 	case ct&majorMask == 25:
-		b := make([]byte, 2)
-		_, err := io.ReadAtLeast(r.in, b, 2)
-		if err != nil {
+		b := r.scratch[:2]
+		if err := r.readFull(b); err != nil {
 			return 0, 0, false, err
 		}
 		u = uint64(binary.BigEndian.Uint16(b))
 
 	case ct&majorMask == 26:
-		b := make([]byte, 4)
-		_, err := io.ReadAtLeast(r.in, b, 4)
-		if err != nil {
+		b := r.scratch[:4]
+		if err := r.readFull(b); err != nil {
 			return 0, 0, false, err
 		}
 		u = uint64(binary.BigEndian.Uint32(b))
 
 	case ct&majorMask == 27:
-		b := make([]byte, 8)
-		_, err := io.ReadAtLeast(r.in, b, 8)
-		if err != nil {
+		b := r.scratch[:8]
+		if err := r.readFull(b); err != nil {
 			return 0, 0, false, err
 		}
 		u = uint64(binary.BigEndian.Uint64(b))
 
+	case ct&majorMask == indefiniteLength:
+		// Strings, arrays and maps may have indefinite length, and in major
+		// type 7 this is the break code ending such an item. The caller has
+		// to look at ct to tell these apart from a length of zero.
+		switch ct & majorSelect {
+		case majorBytes, majorString, majorArray, majorMap, majorOther:
+			u = 0
+		default:
+			return 0, 0, false, InvalidCBORError
+		}
+
 	default:
 		return 0, 0, false, InvalidCBORError
 	}
@@ -141,13 +350,299 @@ func (r *CBORReader) readBasicUnsigned(mt byte) (uint64, byte, bool, error) {
 	return u, ct, neg, nil
 }
 
-// ReadInt reads a numerical type and sets the sign accordingly.
+// readLength reads the head of an array or map of major type mt and returns
+// the number of items it holds, or -1 if it has indefinite length.
+func (r *CBORReader) readLength(mt byte) (int, error) {
+	u, ct, _, err := r.readBasicUnsigned(mt)
+	if err != nil {
+		return 0, err
+	}
+	if ct&majorMask == indefiniteLength {
+		return -1, nil
+	}
+	if u > maxInt {
+		return 0, InvalidCBORError
+	}
+	if r.elementLimit > 0 && u > r.elementLimit {
+		return 0, ElementLimitError
+	}
+	return int(u), nil
+}
+
+// hasNext reports whether a container of n items, as returned by readLength,
+// has another item after the first i. For indefinite-length containers it
+// looks for the break code and consumes it.
+func (r *CBORReader) hasNext(i, n int) (bool, error) {
+	if n >= 0 {
+		return i < n, nil
+	}
+	ct, err := r.readType()
+	if err != nil {
+		return false, err
+	}
+	if ct == breakCode {
+		return false, nil
+	}
+	r.pushbackType(ct)
+	if r.elementLimit > 0 && uint64(i) >= r.elementLimit {
+		return false, ElementLimitError
+	}
+	return true, nil
+}
+
+// readBasicBytes reads a byte or text string of major type mt. The chunks of
+// an indefinite-length string are concatenated into a single value.
+func (r *CBORReader) readBasicBytes(mt byte) ([]byte, error) {
+	u, ct, _, err := r.readBasicUnsigned(mt)
+	if err != nil {
+		return nil, err
+	}
+
+	if ct&majorMask != indefiniteLength {
+		if u > maxInt {
+			return nil, InvalidCBORError
+		}
+		if r.stringLimit > 0 && u > r.stringLimit {
+			return nil, StringLimitError
+		}
+		return r.readBytes(u)
+	}
+
+	// Each chunk must be a definite-length string of the same major type.
+	out := []byte{}
+	for {
+		ct, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		if ct == breakCode {
+			return out, nil
+		}
+		if ct&majorSelect != mt || ct&majorMask == indefiniteLength {
+			return nil, InvalidCBORError
+		}
+		r.pushbackType(ct)
+		chunk, err := r.readBasicBytes(mt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		if r.stringLimit > 0 && uint64(len(out)) > r.stringLimit {
+			return nil, StringLimitError
+		}
+	}
+}
+
+// readNull consumes the next item if it is null, and reports whether it was.
+func (r *CBORReader) readNull() (bool, error) {
+	ct, err := r.readType()
+	if err != nil {
+		return false, err
+	}
+	if ct == 0xf6 {
+		return true, nil
+	}
+	r.pushbackType(ct)
+	return false, nil
+}
+
+// PeekType returns the major type and the additional information, the low
+// five bits of the initial byte, of the next item without consuming it.
+// Self-describe tags in front of the item are skipped.
+func (r *CBORReader) PeekType() (MajorType, byte, error) {
+	ct, err := r.readType()
+	if err != nil {
+		return 0, 0, err
+	}
+	r.pushbackType(ct)
+	return MajorType(ct >> 5), ct & majorMask, nil
+}
+
+// Skip consumes the next item, including everything nested in it, without
+// decoding it. Limits apply as for any other read.
+func (r *CBORReader) Skip() error {
+	ct, err := r.readType()
+	if err != nil {
+		return err
+	}
+	if ct == breakCode {
+		return InvalidCBORError
+	}
+	r.pushbackType(ct)
+
+	switch mt := ct & majorSelect; mt {
+	case majorUnsigned, majorNegative:
+		_, _, _, err := r.readBasicUnsigned(majorUnsigned)
+		return err
+	case majorBytes, majorString:
+		_, err := r.skipString(mt)
+		return err
+	case majorArray, majorMap:
+		n, err := r.readLength(mt)
+		if err != nil {
+			return err
+		}
+		if err := r.enter(); err != nil {
+			return err
+		}
+		defer r.leave()
+		for i := 0; ; i++ {
+			if more, err := r.hasNext(i, n); err != nil {
+				return err
+			} else if !more {
+				return nil
+			}
+			if err := r.Skip(); err != nil {
+				return err
+			}
+			if mt == majorMap {
+				if err := r.Skip(); err != nil {
+					return err
+				}
+			}
+		}
+	case majorTag:
+		if _, err := r.ReadTag(); err != nil {
+			return err
+		}
+		if err := r.enter(); err != nil {
+			return err
+		}
+		defer r.leave()
+		return r.Skip()
+	default:
+		u, _, _, err := r.readBasicUnsigned(majorOther)
+		if err == nil && ct&majorMask == 24 && u < 32 {
+			return InvalidCBORError
+		}
+		return err
+	}
+}
+
+// skipString consumes a byte or text string of major type mt and returns its
+// length, checking the same rules as readBasicBytes.
+func (r *CBORReader) skipString(mt byte) (uint64, error) {
+	u, ct, _, err := r.readBasicUnsigned(mt)
+	if err != nil {
+		return 0, err
+	}
+
+	if ct&majorMask != indefiniteLength {
+		if u > maxInt {
+			return 0, InvalidCBORError
+		}
+		if r.stringLimit > 0 && u > r.stringLimit {
+			return 0, StringLimitError
+		}
+		return u, r.discard(u)
+	}
+
+	var total uint64
+	for {
+		ct, err := r.readType()
+		if err != nil {
+			return 0, err
+		}
+		if ct == breakCode {
+			return total, nil
+		}
+		if ct&majorSelect != mt || ct&majorMask == indefiniteLength {
+			return 0, InvalidCBORError
+		}
+		r.pushbackType(ct)
+		n, err := r.skipString(mt)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+		if r.stringLimit > 0 && total > r.stringLimit {
+			return 0, StringLimitError
+		}
+	}
+}
+
+// discard consumes n bytes of input through the scratch buffer.
+func (r *CBORReader) discard(n uint64) error {
+	for n > 0 {
+		b := r.scratch[:]
+		if n < uint64(len(b)) {
+			b = b[:n]
+		}
+		if err := r.readFull(b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		n -= uint64(len(b))
+	}
+	return nil
+}
+
+// ReadRaw reads the next item and returns its encoding exactly as it appears
+// in the input.
+func (r *CBORReader) ReadRaw() (RawMessage, error) {
+	r.capturing = true
+	r.captured = nil
+	defer func() {
+		r.capturing = false
+		r.captured = nil
+	}()
+	if err := r.Skip(); err != nil {
+		return nil, err
+	}
+	return RawMessage(r.captured), nil
+}
+
+// ReadEmbedded reads an encoded CBOR data item with tag 24, and unmarshals
+// the item held in its byte string into x. The byte string must hold exactly
+// one item. Unmarshaling into a *RawMessage returns the encoded item itself.
+func (r *CBORReader) ReadEmbedded(x interface{}) error {
+	tag, err := r.ReadTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagEmbedded {
+		return fmt.Errorf("unexpected tag %d, expected %d", tag, TagEmbedded)
+	}
+	b, err := r.ReadBytes()
+	if err != nil {
+		return err
+	}
+	sr := r.subReader(b)
+	if err := sr.Unmarshal(x); err != nil {
+		return err
+	}
+	if sr.offset != int64(len(b)) {
+		return fmt.Errorf("%w %d: %d bytes of trailing data", TagContentError, tag, int64(len(b))-sr.offset)
+	}
+	return nil
+}
+
+// subReader returns a reader with the same configuration as r reading from
+// b, which counts towards the depth of nesting of r.
+func (r *CBORReader) subReader(b []byte) *CBORReader {
+	sr := NewCBORReader(bytes.NewReader(b))
+	sr.stringLimit = r.stringLimit
+	sr.elementLimit = r.elementLimit
+	sr.depthLimit = r.depthLimit
+	sr.depth = r.depth
+	sr.decodeBase64 = r.decodeBase64
+	sr.regTags = r.regTags
+	return sr
+}
+
+// ReadInt reads a numerical type and sets the sign accordingly. Returns
+// IntegerOverflowError if the value does not fit into an int.
 func (r *CBORReader) ReadInt() (int, error) {
 	var i int
 	u, _, neg, err := r.readBasicUnsigned(majorUnsigned)
 	if err != nil {
 		return 0, err
 	}
+	if u > maxInt {
+		return 0, IntegerOverflowError
+	}
 
 	// negate if necessary and return
 	if neg {
@@ -159,6 +654,24 @@ func (r *CBORReader) ReadInt() (int, error) {
 	return i, nil
 }
 
+// readInteger reads a numerical type as the smallest of int, uint64 and
+// *big.Int able to hold it.
+func (r *CBORReader) readInteger() (interface{}, error) {
+	u, _, neg, err := r.readBasicUnsigned(majorUnsigned)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case u <= maxInt && neg:
+		return -1 - int(u), nil
+	case u <= maxInt:
+		return int(u), nil
+	case neg:
+		return bigIntFromUnsigned(u, neg), nil
+	}
+	return u, nil
+}
+
 // ReadUint reads an numerical type but discards the sign information if any.
 func (r *CBORReader) ReadUint() (uint64, error) {
 	if u, _, _, err := r.readBasicUnsigned(majorUnsigned); err != nil {
@@ -178,9 +691,193 @@ func (r *CBORReader) ReadTag() (CBORTag, error) {
 	return CBORTag(u), nil
 }
 
+// ReadBigInt reads an integer of arbitrary size, either a plain integer or a
+// bignum with tag 2 or 3.
+func (r *CBORReader) ReadBigInt() (*big.Int, error) {
+	ct, err := r.readType()
+	if err != nil {
+		return nil, err
+	}
+	r.pushbackType(ct)
+
+	switch ct & majorSelect {
+	case majorUnsigned, majorNegative:
+		u, _, neg, err := r.readBasicUnsigned(majorUnsigned)
+		if err != nil {
+			return nil, err
+		}
+		return bigIntFromUnsigned(u, neg), nil
+	case majorTag:
+		tag, err := r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		if tag != TagPosBignum && tag != TagNegBignum {
+			return nil, fmt.Errorf("unexpected tag %d for big integer", tag)
+		}
+		b, err := r.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		return bigIntFromBignum(tag, b), nil
+	}
+	return nil, CBORTypeReadError
+}
+
+// bigIntFromUnsigned returns the value of an integer with argument u, which
+// is -1 - u for negative integers.
+func bigIntFromUnsigned(u uint64, neg bool) *big.Int {
+	b := new(big.Int).SetUint64(u)
+	if neg {
+		b.Neg(b).Sub(b, big.NewInt(1))
+	}
+	return b
+}
+
+// bigIntFromBignum returns the value of the byte string b tagged with tag.
+func bigIntFromBignum(tag CBORTag, b []byte) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if tag == TagNegBignum {
+		v.Neg(v).Sub(v, big.NewInt(1))
+	}
+	return v
+}
+
+// bigIntFromElement converts a value returned by Read into a big.Int.
+func bigIntFromElement(elem TaggedElement) (*big.Int, error) {
+	switch v := elem.Value.(type) {
+	case *big.Int:
+		if elem.Tag == CBORTag(0) {
+			return v, nil
+		}
+	case int:
+		if elem.Tag == CBORTag(0) {
+			return big.NewInt(int64(v)), nil
+		}
+	case uint64:
+		if elem.Tag == CBORTag(0) {
+			return new(big.Int).SetUint64(v), nil
+		}
+	case []byte:
+		if elem.Tag == TagPosBignum || elem.Tag == TagNegBignum {
+			return bigIntFromBignum(elem.Tag, v), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T with tag %d to big.Int", elem.Value, elem.Tag)
+}
+
+// readMantExp reads the [exponent, mantissa] array of a number tagged with
+// tag, which is either TagDecimal or TagBigFloat.
+func (r *CBORReader) readMantExp(tag CBORTag) (*big.Int, int, error) {
+	t, err := r.ReadTag()
+	if err != nil {
+		return nil, 0, err
+	}
+	if t != tag {
+		return nil, 0, fmt.Errorf("unexpected tag %d, expected %d", t, tag)
+	}
+	n, err := r.readLength(majorArray)
+	if err != nil {
+		return nil, 0, err
+	}
+	notMantExp := fmt.Errorf("tag %d content is not an [exponent, mantissa] array", tag)
+	if n >= 0 && n != 2 {
+		return nil, 0, notMantExp
+	}
+
+	// an indefinite-length array must also hold exactly two items
+	next := func(i int, want bool) error {
+		if more, err := r.hasNext(i, n); err != nil {
+			return err
+		} else if more != want {
+			return notMantExp
+		}
+		return nil
+	}
+	if err := next(0, true); err != nil {
+		return nil, 0, err
+	}
+	exp, err := r.ReadInt()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := next(1, true); err != nil {
+		return nil, 0, err
+	}
+	m, err := r.ReadBigInt()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := next(2, false); err != nil {
+		return nil, 0, err
+	}
+	return m, exp, nil
+}
+
+// ReadDecimal reads a decimal fraction with tag 4.
+func (r *CBORReader) ReadDecimal() (Decimal, error) {
+	m, exp, err := r.readMantExp(TagDecimal)
+	if err != nil {
+		return Decimal{}, err
+	}
+	return Decimal{Mantissa: m, Exponent: exp}, nil
+}
+
+// ReadBigFloat reads a bigfloat with tag 5. The result has enough precision to
+// hold the mantissa exactly.
+func (r *CBORReader) ReadBigFloat() (*big.Float, error) {
+	m, exp, err := r.readMantExp(TagBigFloat)
+	if err != nil {
+		return nil, err
+	}
+	return newBigFloat(m, exp), nil
+}
+
+// setInteger stores the integer v, as returned by Read, in out, which must be
+// of an integer kind. Returns IntegerOverflowError if v does not fit.
+func setInteger(out reflect.Value, v interface{}) error {
+	var b *big.Int
+	switch i := v.(type) {
+	case int:
+		b = big.NewInt(int64(i))
+	case uint64:
+		b = new(big.Int).SetUint64(i)
+	case *big.Int:
+		b = i
+	default:
+		return fmt.Errorf("cannot store %T in %v", v, out.Type())
+	}
+
+	switch out.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !b.IsInt64() || out.OverflowInt(b.Int64()) {
+			return fmt.Errorf("%w: %v does not fit into %v", IntegerOverflowError, b, out.Type())
+		}
+		out.SetInt(b.Int64())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !b.IsUint64() || out.OverflowUint(b.Uint64()) {
+			return fmt.Errorf("%w: %v does not fit into %v", IntegerOverflowError, b, out.Type())
+		}
+		out.SetUint(b.Uint64())
+	default:
+		return fmt.Errorf("cannot store an integer in %v", out.Type())
+	}
+	return nil
+}
+
 // ReadFloat reads a floating point type.
 func (r *CBORReader) ReadFloat() (float64, error) {
-	u, ct, _, err := r.readBasicUnsigned(majorOther)
+	// check the type before reading any argument bytes, so that other items
+	// are left in the input
+	ct, err := r.readType()
+	if err != nil {
+		return 0, err
+	}
+	r.pushbackType(ct)
+	if ct != majorOther|25 && ct != majorOther|26 && ct != majorOther|27 {
+		return 0, CBORTypeReadError
+	}
+	u, _, _, err := r.readBasicUnsigned(majorOther)
 	if err != nil {
 		return 0, err
 	}
@@ -188,120 +885,145 @@ func (r *CBORReader) ReadFloat() (float64, error) {
 	var f float64
 	switch ct {
 	case majorOther | 25:
-		// FIXME: float16 is not supported right now.
-		return 0, UnsupportedTypeReadError
+		// 16 bit float.
+		f = float16ToFloat64(uint16(u))
 	case majorOther | 26:
 		// 32 bit float.
 		f = float64(math.Float32frombits(uint32(u)))
 	case majorOther | 27:
 		// 64 bit float.
 		f = math.Float64frombits(u)
-	default:
-		r.pushbackType(ct)
-		return 0, CBORTypeReadError
 	}
 
 	return f, nil
 }
 
-// ReadBytes reads the byte array type.
-func (r *CBORReader) ReadBytes() ([]byte, error) {
-	// read length
-	u, _, _, err := r.readBasicUnsigned(majorBytes)
+// ReadSimple reads a simple value, including false, true, null and
+// undefined. Floats are not simple values. Values below 32 in the two byte
+// form, which includes the reserved values 24 to 31, are invalid.
+func (r *CBORReader) ReadSimple() (SimpleValue, error) {
+	ct, err := r.readType()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-
-	// read u bytes and return them
-	b := make([]byte, u)
-	_, err = io.ReadAtLeast(r.in, b, int(u))
+	r.pushbackType(ct)
+	if ct&majorSelect != majorOther || ct&majorMask > 24 {
+		return 0, CBORTypeReadError
+	}
+	u, _, _, err := r.readBasicUnsigned(majorOther)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	if ct&majorMask == 24 && u < 32 {
+		return 0, InvalidCBORError
+	}
+	return SimpleValue(u), nil
+}
 
-	return b, nil
+// ReadBytes reads the byte array type.
+func (r *CBORReader) ReadBytes() ([]byte, error) {
+	return r.readBasicBytes(majorBytes)
 }
 
 // ReadString reads a string type.
 func (r *CBORReader) ReadString() (string, error) {
-	// read length
-	u, _, _, err := r.readBasicUnsigned(majorString)
+	b, err := r.readBasicBytes(majorString)
 	if err != nil {
 		return "", err
 	}
-
-	// empty string special case.
-	if u == 0 {
-		return "", nil
-	}
-
-	// read u bytes and return them as a string
-	b := make([]byte, u)
-	_, err = io.ReadAtLeast(r.in, b, int(u))
-	if err != nil {
-		return "", err
-	}
-
 	return string(b), nil
 }
 
 // ReadArray reads an arbitrary array type.
 func (r *CBORReader) ReadArray() ([]TaggedElement, error) {
 	// read length
-	u, _, _, err := r.readBasicUnsigned(majorArray)
+	n, err := r.readLength(majorArray)
 	if err != nil {
 		return nil, err
 	}
-
-	arraylen := int(u)
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
 
 	// create an output value
-	out := make([]TaggedElement, arraylen)
+	out := []TaggedElement{}
 
-	// now read that many values
-	for i := 0; i < arraylen; i++ {
-		var elem TaggedElement
-		v, err := r.Read()
-		if err != nil {
+	// now read that many values, or up to the break
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
 			return nil, err
+		} else if !more {
+			break
 		}
-		if tag, ok := v.(CBORTag); ok {
-			// The thing we have read here is a CBOR tag, so we have to read again to get the tagged element.
-			te, err := r.Read()
-			if err != nil {
-				return nil, err
-			}
-			elem.Tag = tag
-			elem.Value = te
-		} else {
-			elem.Value = v
+		elem, err := r.readElement()
+		if err != nil {
+			return nil, err
 		}
-		out[i] = elem
+		out = append(out, elem)
 	}
 
 	return out, nil
 }
 
+// readElement reads the next value together with its tag, if it has one. The
+// content of tags with known semantics is checked. A value with several tags
+// keeps the outermost one, and has the rest of it as a TaggedElement value.
+func (r *CBORReader) readElement() (TaggedElement, error) {
+	var elem TaggedElement
+	v, err := r.Read()
+	if err != nil {
+		return elem, err
+	}
+	tag, ok := v.(CBORTag)
+	if !ok {
+		elem.Value = v
+		return elem, nil
+	}
+
+	// The thing we have read here is a CBOR tag, so we have to read again to
+	// get the tagged element. Tags count as a level of nesting, so that
+	// the depth limit also bounds chains of tags.
+	if err := r.enter(); err != nil {
+		return elem, err
+	}
+	defer r.leave()
+	inner, err := r.readElement()
+	if err != nil {
+		return elem, err
+	}
+	elem.Tag = tag
+	if inner.Tag != CBORTag(0) {
+		elem.Value = inner
+		return elem, nil
+	}
+	elem.Value, err = checkTagContent(tag, inner.Value, r.decodeBase64)
+	return elem, err
+}
+
 // ReadStringArray reads an array of strings.
 func (r *CBORReader) ReadStringArray() ([]string, error) {
 	// read length
-	u, _, _, err := r.readBasicUnsigned(majorArray)
+	n, err := r.readLength(majorArray)
 	if err != nil {
 		return nil, err
 	}
 
-	arraylen := int(u)
-
 	// create an output value
-	out := make([]string, arraylen)
+	out := []string{}
 
-	// now read that many values
-	for i := 0; i < arraylen; i++ {
+	// now read that many values, or up to the break
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return nil, err
+		} else if !more {
+			break
+		}
 		v, err := r.ReadString()
 		if err != nil {
 			return nil, err
 		}
-		out[i] = v
+		out = append(out, v)
 	}
 
 	return out, nil
@@ -310,23 +1032,26 @@ func (r *CBORReader) ReadStringArray() ([]string, error) {
 // ReadIntArray reads an array of integers.
 func (r *CBORReader) ReadIntArray() ([]int, error) {
 	// read length
-	u, _, _, err := r.readBasicUnsigned(majorArray)
+	n, err := r.readLength(majorArray)
 	if err != nil {
 		return nil, err
 	}
 
-	arraylen := int(u)
-
 	// create an output value
-	out := make([]int, arraylen)
+	out := []int{}
 
 	// now read as many values as there should be
-	for i := 0; i < arraylen; i++ {
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return nil, err
+		} else if !more {
+			break
+		}
 		v, err := r.ReadInt()
 		if err != nil {
 			return nil, err
 		}
-		out[i] = v
+		out = append(out, v)
 	}
 
 	return out, nil
@@ -335,18 +1060,30 @@ func (r *CBORReader) ReadIntArray() ([]int, error) {
 // ReadStringMap reads a CBOR map type.
 func (r *CBORReader) ReadStringMap() (map[string]TaggedElement, error) {
 	// read length
-	u, _, _, err := r.readBasicUnsigned(majorMap)
+	n, err := r.readLength(majorMap)
 	if err != nil {
 		return nil, err
 	}
+	return r.readStringMap(n)
+}
 
-	maplen := int(u)
+// readStringMap reads the n key/value pairs of a map whose head has been read.
+func (r *CBORReader) readStringMap(n int) (map[string]TaggedElement, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
 
 	// create an output value
 	out := make(map[string]TaggedElement)
 
 	// now read as many key/value pairs as there should be
-	for i := 0; i < maplen; i++ {
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return nil, err
+		} else if !more {
+			break
+		}
 		var ks string
 		k, err := r.Read()
 		if err != nil {
@@ -358,21 +1095,10 @@ func (r *CBORReader) ReadStringMap() (map[string]TaggedElement, error) {
 		default:
 			ks = fmt.Sprintf("%v", k)
 		}
-		var res TaggedElement
-		v, err := r.Read()
+		res, err := r.readElement()
 		if err != nil {
 			return nil, err
 		}
-		if t, ok := v.(CBORTag); ok {
-			res.Tag = t
-			iv, err := r.Read()
-			if err != nil {
-				return nil, err
-			}
-			res.Value = iv
-		} else {
-			res.Value = v
-		}
 
 		out[ks] = res
 	}
@@ -433,6 +1159,21 @@ func (r *CBORReader) UntagArray(in []TaggedElement) []interface{} {
 	return out
 }
 
+// untagValue removes the tags from a value returned by Read, recursing into
+// maps and arrays.
+func untagValue(v interface{}) interface{} {
+	var r *CBORReader
+	switch t := v.(type) {
+	case map[string]TaggedElement:
+		return r.UntagStringMap(t)
+	case map[int]TaggedElement:
+		return r.UntagIntMap(t)
+	case []TaggedElement:
+		return r.UntagArray(t)
+	}
+	return v
+}
+
 func (r *CBORReader) ReadIntMapUntagged() (map[int]interface{}, error) {
 	m, err := r.ReadIntMap()
 	if err != nil {
@@ -444,164 +1185,199 @@ func (r *CBORReader) ReadIntMapUntagged() (map[int]interface{}, error) {
 // ReadIntMap reads an integer keyed map.
 func (r *CBORReader) ReadIntMap() (map[int]TaggedElement, error) {
 	// read length
-	u, _, _, err := r.readBasicUnsigned(majorMap)
+	n, err := r.readLength(majorMap)
 	if err != nil {
 		return nil, err
 	}
+	return r.readIntMap(n)
+}
 
-	maplen := int(u)
+// readIntMap reads the n key/value pairs of a map whose head has been read.
+func (r *CBORReader) readIntMap(n int) (map[int]TaggedElement, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
 
 	// create an output value
 	out := make(map[int]TaggedElement)
 
 	// now read as many key/value pairs as there should be
-	for i := 0; i < maplen; i++ {
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return nil, err
+		} else if !more {
+			break
+		}
 		k, err := r.ReadInt()
 		if err != nil {
 			return nil, err
 		}
 
-		var res TaggedElement
-
-		v, err := r.Read()
+		res, err := r.readElement()
 		if err != nil {
 			return nil, err
 		}
 
-		if t, ok := v.(CBORTag); ok {
-			inner, err := r.Read()
-			if err != nil {
-				return nil, err
-			}
-			res.Tag = t
-			res.Value = inner
-		} else {
-			res.Value = v
+		out[k] = res
+	}
+
+	return out, nil
+}
+
+// ReadTime reads a timestamp. Both standard date/time tags are accepted: tag 0
+// with an RFC 3339 string, and tag 1 with an integer or floating point number
+// of seconds since the epoch. An untagged string or number is read as if it
+// were tagged. Floating point timestamps are rounded to the nearest
+// nanosecond. Extended times with tag 1001 and dates with tags 100 and 1004
+// are read as well, the latter as midnight UTC.
+func (r *CBORReader) ReadTime() (time.Time, error) {
+	ct, err := r.readType()
+	if err != nil {
+		return time.Time{}, err
+	}
+	r.pushbackType(ct)
+
+	var elem TaggedElement
+	if ct&majorSelect == majorTag {
+		if elem.Tag, err = r.ReadTag(); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if elem.Value, err = r.Read(); err != nil {
+		return time.Time{}, err
+	}
+	return timeFromElement(elem)
+}
+
+// timeFromElement converts a value returned by Read into a time.
+func timeFromElement(elem TaggedElement) (time.Time, error) {
+	switch elem.Tag {
+	case TagDateTimeString, TagDateTimeEpoch:
+	case TagDateEpochDays, TagDateString:
+		d, err := dateFromElement(elem)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return d.In(time.UTC), nil
+	case TagExtendedTime:
+		m, ok := elem.Value.(map[int]TaggedElement)
+		if !ok {
+			return time.Time{}, fmt.Errorf("extended time is not an integer keyed map")
+		}
+		return timeFromExtended(m)
+	default:
+		return time.Time{}, fmt.Errorf("unrecognized time tag %d", elem.Tag)
+	}
+
+	switch v := elem.Value.(type) {
+	case string:
+		if elem.Tag == TagDateTimeEpoch {
+			return time.Time{}, fmt.Errorf("epoch timestamp must be a number, not a string")
 		}
+		return time.Parse(time.RFC3339Nano, v)
+	case int:
+		return time.Unix(int64(v), 0), nil
+	case float64:
+		if math.IsNaN(v) || math.Abs(v) >= math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("timestamp %v out of range", v)
+		}
+		whole, frac := math.Modf(v)
+		return time.Unix(int64(whole), int64(math.Round(frac*1e9))), nil
+	}
+	return time.Time{}, fmt.Errorf("timestamp not understood: %v", elem.Value)
+}
 
-		out[k] = res
+// ReadURI reads a URI with tag 32.
+func (r *CBORReader) ReadURI() (*url.URL, error) {
+	tag, err := r.ReadTag()
+	if err != nil {
+		return nil, err
+	}
+	if tag != TagURI {
+		return nil, fmt.Errorf("unexpected tag %d, expected %d", tag, TagURI)
+	}
+	s, err := r.ReadString()
+	if err != nil {
+		return nil, err
 	}
+	return urlFromElement(TaggedElement{Tag: tag, Value: s})
+}
 
-	return out, nil
+// ReadUUID reads a UUID with tag 37.
+func (r *CBORReader) ReadUUID() (UUID, error) {
+	tag, err := r.ReadTag()
+	if err != nil {
+		return UUID{}, err
+	}
+	if tag != TagUUID {
+		return UUID{}, fmt.Errorf("unexpected tag %d, expected %d", tag, TagUUID)
+	}
+	b, err := r.ReadBytes()
+	if err != nil {
+		return UUID{}, err
+	}
+	return uuidFromElement(TaggedElement{Tag: tag, Value: b})
 }
 
-// ReadTime reads a timestamp.
-func (r *CBORReader) ReadTime() (time.Time, error) {
-	// Case 1: the time is just a float, integer, or string.
-	// In this case we just treat it as if it were tagged.
-	ct, err := r.readType()
+// ReadAddr reads an IP address with tag 52 or 54.
+func (r *CBORReader) ReadAddr() (netip.Addr, error) {
+	tag, err := r.ReadTag()
 	if err != nil {
-		return time.Unix(0, 0), err
+		return netip.Addr{}, err
 	}
-	switch ct & majorMask {
-	case majorOther:
-		if ct == majorOther|25 || ct == majorOther|26 || ct == majorOther|27 {
-			// Floating point timestamp.
-			r.pushbackType(ct)
-			f, err := r.ReadFloat()
-			if err != nil {
-				return time.Unix(0, 0), err
-			}
-			whole, frac := math.Modf(f)
-			secs := int64(whole)
-			ns := int64(frac * 10e9)
-			return time.Unix(secs, ns), nil
-		}
-		return time.Unix(0, 0), fmt.Errorf("got malformed majorOther type for timestamp: %x", ct)
-	case majorNegative:
-		fallthrough
-	case majorUnsigned:
-		r.pushbackType(ct)
-		i, err := r.ReadInt()
-		if err != nil {
-			return time.Unix(0, 0), err
-		}
-		return time.Unix(int64(i), 0), nil
-	case majorString:
-		r.pushbackType(ct)
-		s, err := r.ReadString()
-		if err != nil {
-			return time.Unix(0, 0), err
-		}
-		if t, err := time.Parse(time.RFC3339, s); err != nil {
-			return time.Unix(0, 0), err
-		} else {
-			return t, nil
-		}
-	case majorTag:
-		break // Fall through to the tag logic below.
-	default:
-		return time.Unix(0, 0), fmt.Errorf("unsupported tag for parsing time: %v", ct&majorMask)
+	b, err := r.ReadBytes()
+	if err != nil {
+		return netip.Addr{}, err
 	}
+	return addrFromElement(TaggedElement{Tag: tag, Value: b})
+}
+
+// ReadPrefix reads an IP prefix with tag 52 or 54.
+func (r *CBORReader) ReadPrefix() (netip.Prefix, error) {
 	tag, err := r.ReadTag()
 	if err != nil {
-		return time.Unix(0, 0), err
+		return netip.Prefix{}, err
 	}
-	// Two tags are allowed: 0 for RFC3339 time, 1 for POSIX epoch time.
-	switch tag {
-	case TagDateTimeString:
-		s, err := r.ReadString()
-		if err != nil {
-			return time.Unix(0, 0), err
-		}
-		if t, err := time.Parse(time.RFC3339, s); err != nil {
-			return time.Unix(0, 0), err
-		} else {
-			return t, nil
-		}
-	case TagDateTimeEpoch:
-		// This representation is in POSIX timestamp format in either positive
-		// or negative integer, or floating point number.
-		ct, err := r.readType()
-		if err != nil {
-			return time.Unix(0, 0), err
-		}
-		switch ct & majorMask {
-		case majorNegative:
-			fallthrough
-		case majorUnsigned:
-			r.pushbackType(ct)
-			if i, err := r.ReadInt(); err != nil {
-				return time.Unix(0, 0), err
-			} else {
-				return time.Unix(int64(i), 0), nil
-			}
-		case majorOther:
-			if ct == majorOther|25 || ct == majorOther|26 || ct == majorOther|27 {
-				r.pushbackType(ct)
-				f, err := r.ReadFloat()
-				if err != nil {
-					return time.Unix(0, 0), err
-				}
-				whole, frac := math.Modf(f)
-				secs := int64(whole)
-				ns := int64(frac * 10e9)
-				return time.Unix(secs, ns), nil
-			} else {
-				return time.Unix(0, 0), fmt.Errorf("got malformed majorOther type for timestamp: %x", ct)
-			}
-		default:
-			return time.Unix(0, 0), fmt.Errorf("timestamp not understood")
-		}
-	default:
-		return time.Unix(0, 0), fmt.Errorf("unrecognized time tag")
+	a, err := r.ReadArray()
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefixFromElement(TaggedElement{Tag: tag, Value: a})
+}
+
+// ReadDate reads a calendar date with tag 100 or 1004.
+func (r *CBORReader) ReadDate() (Date, error) {
+	tag, err := r.ReadTag()
+	if err != nil {
+		return Date{}, err
 	}
+	if tag != TagDateEpochDays && tag != TagDateString {
+		return Date{}, fmt.Errorf("unrecognized date tag %d", tag)
+	}
+	v, err := r.Read()
+	if err != nil {
+		return Date{}, err
+	}
+	return dateFromElement(TaggedElement{Tag: tag, Value: v})
 }
 
 // Read reads the next value as an arbitrary object from the CBOR reader. It
 // returns a single interface{} of one of the following types, depending on the
 // major type of the next CBOR object in the stream:
 //
-// - Unsigned (major 0): uint
-// - Negative (major 1): int
+// - Unsigned (major 0): int, or uint64 if the value does not fit into an int
+// - Negative (major 1): int, or *big.Int if the value does not fit into an int
 // - Byte array (major 2): []byte
 // - String (major 3): string
 // - Array (major 4): []interface{}
-// - Map (major 5): map[string]interface{}, with keys coerced to strings via Sprintf("%v").
+// - Map (major 5): map[int]TaggedElement if the first key is an integer,
+//   otherwise map[string]TaggedElement, with keys coerced to strings via Sprintf("%v").
 // - Tag (major 6): CBORTag type
 // - Other (major 7) float: float64
 // - Other (major 7) true or false: bool
 // - Other (major 7) nil: nil
+// - Other (major 7) undefined and other simple values: SimpleValue
 // - anything else: currently an error
 
 func (r *CBORReader) Read() (interface{}, error) {
@@ -613,7 +1389,7 @@ func (r *CBORReader) Read() (interface{}, error) {
 	switch ct & majorSelect {
 	case majorUnsigned, majorNegative:
 		r.pushbackType(ct)
-		return r.ReadInt()
+		return r.readInteger()
 	case majorBytes:
 		r.pushbackType(ct)
 		return r.ReadBytes()
@@ -627,16 +1403,22 @@ func (r *CBORReader) Read() (interface{}, error) {
 		// When we are reading a map it can either be a int map or a string map.
 		// To know which variant we are dealing with, we sample the first key
 		// and use that to decide which variant parser to call.
-		it, err := r.readType()
+		r.pushbackType(ct)
+		n, err := r.readLength(majorMap)
 		if err != nil {
 			return nil, err
 		}
-		r.pushbackType(ct)
-		r.pushbackType(it)
-		if it&majorSelect == majorUnsigned {
-			return r.ReadIntMap()
+		var it byte
+		if n != 0 {
+			if it, err = r.readType(); err != nil {
+				return nil, err
+			}
+			r.pushbackType(it)
+		}
+		if n != 0 && (it&majorSelect == majorUnsigned || it&majorSelect == majorNegative) {
+			return r.readIntMap(n)
 		}
-		return r.ReadStringMap()
+		return r.readStringMap(n)
 	case majorTag:
 		r.pushbackType(ct)
 		return r.ReadTag()
@@ -651,6 +1433,9 @@ func (r *CBORReader) Read() (interface{}, error) {
 			return true, nil
 		case ct == 0xf6:
 			return nil, nil
+		case ct&majorMask <= 24:
+			r.pushbackType(ct)
+			return r.ReadSimple()
 		}
 	}
 
@@ -661,7 +1446,9 @@ func (r *CBORReader) Read() (interface{}, error) {
 // Unmarshal attempts to read the next value from the CBOR reader and store it
 // in the value pointed to by v, according to v's type. Returns
 // CBORTypeReadError if the type does not match or cannot be made to match.
-// Values are handled as in Marshal().
+// Values are handled as in Marshal(). Null sets pointers, slices, maps and
+// interfaces to nil, and pointers are allocated as needed to hold other
+// values.
 func (r *CBORReader) Unmarshal(x interface{}) error {
 	pv := reflect.ValueOf(x)
 
@@ -675,28 +1462,120 @@ func (r *CBORReader) Unmarshal(x interface{}) error {
 		return m.UnmarshalCBOR(r)
 	}
 
+	// raw items, simple values and big numbers have their own encodings
+	switch b := x.(type) {
+	case *SimpleValue:
+		v, err := r.ReadSimple()
+		if err != nil {
+			return err
+		}
+		*b = v
+		return nil
+	case *RawMessage:
+		v, err := r.ReadRaw()
+		if err != nil {
+			return err
+		}
+		*b = v
+		return nil
+	case *big.Int:
+		v, err := r.ReadBigInt()
+		if err != nil {
+			return err
+		}
+		b.Set(v)
+		return nil
+	case *big.Float:
+		v, err := r.ReadBigFloat()
+		if err != nil {
+			return err
+		}
+		b.Set(v)
+		return nil
+	case *Decimal:
+		v, err := r.ReadDecimal()
+		if err != nil {
+			return err
+		}
+		*b = v
+		return nil
+	}
+
+	// null sets pointers, slices, maps and interfaces to nil and addresses
+	// and dates to their zero value
+	if isNullable(pv.Elem().Type()) {
+		if null, err := r.readNull(); err != nil {
+			return err
+		} else if null {
+			pv.Elem().Set(reflect.Zero(pv.Elem().Type()))
+			return nil
+		}
+	}
+
+	// other types with their own representation
+	if isConvertedType(pv.Elem().Type()) {
+		elem, err := r.readElement()
+		if err != nil {
+			return err
+		}
+		return setConverted(pv.Elem(), elem)
+	}
+
 	// make sure the thing is settable
 	if !pv.Elem().CanSet() {
 		return fmt.Errorf("cannot unmarshal CBOR to type %v: not settable by reflection", pv.Type())
 	}
 
+	// containers holding raw items are read piece by piece
+	if k := pv.Elem().Kind(); (k == reflect.Slice || k == reflect.Array || k == reflect.Map) && containsRaw(pv.Elem().Type()) {
+		scs := structCBORSpec{}
+		return r.readValue(&scs, pv.Elem())
+	}
+
 	// otherwise, read value based on value's element kind
 	switch pv.Elem().Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		i, err := r.ReadInt()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if err := r.skipRegisteredTag(pv.Elem().Type()); err != nil {
+			return err
+		}
+		i, err := r.readInteger()
 		if err != nil {
 			return err
 		}
-		pv.Elem().SetInt(int64(i))
-		return nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		i, err := r.ReadInt()
+		return setInteger(pv.Elem(), i)
+	case reflect.Float32, reflect.Float64:
+		if err := r.skipRegisteredTag(pv.Elem().Type()); err != nil {
+			return err
+		}
+		// integers are widened to floats
+		ct, err := r.readType()
+		if err != nil {
+			return err
+		}
+		r.pushbackType(ct)
+		if ct&majorSelect == majorUnsigned || ct&majorSelect == majorNegative {
+			u, _, neg, err := r.readBasicUnsigned(majorUnsigned)
+			if err != nil {
+				return err
+			}
+			if neg {
+				pv.Elem().SetFloat(-1 - float64(u))
+			} else {
+				pv.Elem().SetFloat(float64(u))
+			}
+			return nil
+		}
+		f, err := r.ReadFloat()
 		if err != nil {
 			return err
 		}
-		pv.Elem().SetUint(uint64(i))
+		pv.Elem().SetFloat(f)
 		return nil
 	case reflect.String:
+		if err := r.skipRegisteredTag(pv.Elem().Type()); err != nil {
+			return err
+		}
 		s, err := r.ReadString()
 		if err != nil {
 			return err
@@ -719,16 +1598,35 @@ func (r *CBORReader) Unmarshal(x interface{}) error {
 			}
 			pv.Elem().Set(reflect.ValueOf(sl))
 			return nil
-		default:
+		case reflect.TypeOf([]TaggedElement{}):
 			sl, err := r.ReadArray()
 			if err != nil {
 				return err
 			}
 			pv.Elem().Set(reflect.ValueOf(sl))
 			return nil
+		default:
+			elem, err := r.readElement()
+			if err != nil {
+				return err
+			}
+			scs := structCBORSpec{}
+			return scs.handleElement(pv.Elem(), elem, r.regTags)
+		}
+	case reflect.Map:
+		return r.readReflectedMap(pv.Elem())
+	case reflect.Ptr:
+		if pv.Elem().IsNil() {
+			pv.Elem().Set(reflect.New(pv.Elem().Type().Elem()))
 		}
+		return r.Unmarshal(pv.Elem().Interface())
 	case reflect.Array:
-		return fmt.Errorf("cannot unmarshal objects of type %v from CBOR", pv.Type().Elem())
+		elem, err := r.readElement()
+		if err != nil {
+			return err
+		}
+		scs := structCBORSpec{}
+		return scs.handleElement(pv.Elem(), elem, r.regTags)
 	case reflect.Struct:
 		// treat times sepcially
 		if pv.Elem().Type() == reflect.TypeOf(time.Time{}) {
@@ -745,10 +1643,12 @@ func (r *CBORReader) Unmarshal(x interface{}) error {
 		if err != nil {
 			return err
 		}
-		switch b.(type) {
-		case bool:
-			pv.Elem().Set(reflect.ValueOf(b))
+		v, ok := b.(bool)
+		if !ok {
+			return CBORTypeReadError
 		}
+		pv.Elem().SetBool(v)
+		return nil
 	case reflect.Interface:
 		b, err := r.ReadTag()
 		if err != nil {
@@ -756,7 +1656,7 @@ func (r *CBORReader) Unmarshal(x interface{}) error {
 		}
 		t, ok := r.regTags[b]
 		if !ok {
-			return fmt.Errorf("CBOR tag %d was not registered on this reader", t)
+			return fmt.Errorf("CBOR tag %d was not registered on this reader", b)
 		}
 		// Check if we can assign the type to the interface x. N.B. x is a pointer so use elem.
 		if dt := reflect.TypeOf(x).Elem(); !t.AssignableTo(dt) {
@@ -775,6 +1675,34 @@ func (r *CBORReader) Unmarshal(x interface{}) error {
 	return fmt.Errorf("cannot unmarshal objects of type %v from CBOR", pv.Type().Elem())
 }
 
+// skipRegisteredTag consumes a tag in front of a value of type t, as written
+// by CBORWriter.Marshal for types registered with a tag. Any other tag is an
+// error.
+func (r *CBORReader) skipRegisteredTag(t reflect.Type) error {
+	ct, err := r.readType()
+	if err != nil {
+		return err
+	}
+	r.pushbackType(ct)
+	if ct&majorSelect != majorTag {
+		return nil
+	}
+	tag, err := r.ReadTag()
+	if err != nil {
+		return err
+	}
+	if rt, ok := r.regTags[tag]; !ok || rt != t {
+		return fmt.Errorf("CBOR tag %d is not registered for type %v", tag, t)
+	}
+	return nil
+}
+
+// readReflectedMap reads a map and stores it in pv, converting its keys and
+// values to the key and element types of pv.
+func (r *CBORReader) readReflectedMap(pv reflect.Value) error {
+	return r.readContainerMap(&structCBORSpec{}, pv)
+}
+
 // readReflectedStruct attempts to deserialize a map from the reader that
 // matches the elements of a struct.
 func (r *CBORReader) readReflectedStruct(pv reflect.Value) error {
@@ -792,20 +1720,246 @@ func (r *CBORReader) readReflectedStruct(pv reflect.Value) error {
 		return fmt.Errorf("failed to read tag: %v", err)
 	}
 
-	var m map[string]TaggedElement
+	// A tag must identify the struct type, either by its cborTag marker or
+	// by registration, and is followed by the map.
+	if ct&majorSelect == majorTag {
+		r.pushbackType(ct)
+		tag, err := r.ReadTag()
+		if err != nil {
+			return fmt.Errorf("failed to read tag: %v", err)
+		}
+		if !scs.acceptsTag(tag, pv.Type(), r.regTags) {
+			return fmt.Errorf("CBOR tag %d does not match struct type %v", tag, pv.Type())
+		}
+		if ct, err = r.readType(); err != nil {
+			return err
+		}
+	}
+
 	switch ct & majorSelect {
 	case majorMap:
-		// Read the right kind of map depending on what the struct supports.
-		// TODO: support reading int maps.
 		r.pushbackType(ct)
-		m, err = r.ReadStringMap()
+		n, err := r.readLength(majorMap)
 		if err != nil {
-			return fmt.Errorf("failed to read string map for struct: %v", err)
+			return err
 		}
-	case majorTag:
-		return errors.New("tagged structs are not supported yet")
+		return r.readStructFields(&scs, pv, n)
+	default:
+		r.pushbackType(ct)
+		return CBORTypeReadError
+	}
+}
+
+// readStructFields reads the n key/value pairs of a map whose head has been
+// read into the fields of the struct pv. Fields are read straight from the
+// input, so that RawMessage fields hold the exact bytes of their values.
+func (r *CBORReader) readStructFields(scs *structCBORSpec, pv reflect.Value, n int) error {
+	if !scs.usingIntKeys() && scs.strKeyForField == nil {
+		return fmt.Errorf("cant parse string map for struct type %s", pv.Type().Name())
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
+
+	// map keys to the index of their field
+	fields := make(map[interface{}]int)
+	for i, nf := 0, pv.NumField(); i < nf; i++ {
+		name := pv.Type().Field(i).Name
+		if k, ok := scs.intKeyForField[name]; ok {
+			fields[k] = i
+		} else if k, ok := scs.strKeyForField[name]; ok {
+			fields[k] = i
+		}
+	}
+
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return err
+		} else if !more {
+			return nil
+		}
+
+		// Match the key against the kind of key the struct supports; keys of
+		// any other kind match no field and are skipped.
+		e, err := r.readElement()
+		if err != nil {
+			return fmt.Errorf("failed to read map key for struct: %v", err)
+		}
+		k := e.Value
+		var key interface{}
+		if scs.usingIntKeys() {
+			if i, ok := k.(int); ok {
+				key = i
+			}
+		} else if s, ok := k.(string); ok {
+			key = s
+		} else {
+			key = fmt.Sprintf("%v", k)
+		}
+
+		idx, ok := fields[key]
+		if !ok {
+			if err := r.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.readValue(scs, pv.Field(idx)); err != nil {
+			return fmt.Errorf("field %s of %s: %w", pv.Type().Field(idx).Name, pv.Type().Name(), err)
+		}
+	}
+}
+
+// readValue reads the next value into out, which is a struct field or an
+// element of a container read straight from the input. Values which hold a
+// RawMessage are read piece by piece, so that it gets the exact bytes of its
+// item; everything else is read as a whole and converted.
+func (r *CBORReader) readValue(scs *structCBORSpec, out reflect.Value) error {
+	if out.Kind() == reflect.Ptr && !isConvertedType(out.Type()) {
+		if null, err := r.readNull(); err != nil {
+			return err
+		} else if null {
+			out.Set(reflect.Zero(out.Type()))
+			return nil
+		}
+		if out.IsNil() {
+			out.Set(reflect.New(out.Type().Elem()))
+		}
+		return r.readValue(scs, out.Elem())
+	}
+
+	switch {
+	case out.Type() == rawType:
+		raw, err := r.ReadRaw()
+		if err != nil {
+			return err
+		}
+		out.Set(reflect.ValueOf(raw))
+		return nil
+	case out.Kind() == reflect.Struct && !isConvertedType(out.Type()):
+		return r.readReflectedStruct(out)
+	case out.Kind() == reflect.Map:
+		// Maps are always streamed so that keys keep their full range.
+		return r.readContainerMap(scs, out)
+	case containsRaw(out.Type()):
+		switch out.Kind() {
+		case reflect.Slice, reflect.Array:
+			return r.readContainerArray(scs, out)
+		}
+	}
+	elem, err := r.readElement()
+	if err != nil {
+		return err
+	}
+	return scs.handleElement(out, elem, r.regTags)
+}
+
+// readContainerArray reads an array into the slice or fixed-size array out,
+// reading each element with readValue.
+func (r *CBORReader) readContainerArray(scs *structCBORSpec, out reflect.Value) error {
+	if out.Kind() == reflect.Slice {
+		if null, err := r.readNull(); err != nil {
+			return err
+		} else if null {
+			out.Set(reflect.Zero(out.Type()))
+			return nil
+		}
+	}
+	n, err := r.readLength(majorArray)
+	if err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
+
+	// The length is not trusted for an allocation, slices grow as elements
+	// arrive.
+	slice := reflect.Zero(out.Type())
+	i := 0
+	for ; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return err
+		} else if !more {
+			break
+		}
+		var v reflect.Value
+		if out.Kind() == reflect.Array {
+			if i >= out.Len() {
+				return fmt.Errorf("cannot read array of more than %d elements into %v", out.Len(), out.Type())
+			}
+			v = out.Index(i)
+		} else {
+			v = reflect.New(out.Type().Elem()).Elem()
+		}
+		if err := r.readValue(scs, v); err != nil {
+			return fmt.Errorf("index %d: %w", i, err)
+		}
+		if out.Kind() == reflect.Slice {
+			slice = reflect.Append(slice, v)
+		}
+	}
+	if out.Kind() == reflect.Array {
+		if i != out.Len() {
+			return fmt.Errorf("cannot read array of %d elements into %v", i, out.Type())
+		}
+		return nil
+	}
+	if slice.IsNil() {
+		slice = reflect.MakeSlice(out.Type(), 0, 0)
+	}
+	out.Set(slice)
+	return nil
+}
+
+// readContainerMap reads a map into out, converting its keys as handleMap
+// does and reading each value with readValue.
+func (r *CBORReader) readContainerMap(scs *structCBORSpec, out reflect.Value) error {
+	if null, err := r.readNull(); err != nil {
+		return err
+	} else if null {
+		out.Set(reflect.Zero(out.Type()))
+		return nil
+	}
+	n, err := r.readLength(majorMap)
+	if err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
+
+	if out.IsNil() {
+		out.Set(reflect.MakeMap(out.Type()))
+	}
+	for i := 0; ; i++ {
+		if more, err := r.hasNext(i, n); err != nil {
+			return err
+		} else if !more {
+			return nil
+		}
+		k, err := r.readElement()
+		if err != nil {
+			return err
+		}
+		// Keys other than integers are coerced to strings as in Read.
+		kv := k.Value
+		if _, ok := kv.(string); !ok && !isIntegerValue(kv) {
+			kv = fmt.Sprintf("%v", kv)
+		}
+		key, err := convertMapKey(kv, out.Type().Key())
+		if err != nil {
+			return err
+		}
+		val := reflect.New(out.Type().Elem()).Elem()
+		if err := r.readValue(scs, val); err != nil {
+			return fmt.Errorf("map key %v: %w", kv, err)
+		}
+		out.SetMapIndex(key, val)
 	}
-	return scs.convertStringMapToStruct(m, pv, r.regTags)
 }
 
 type CBORUnmarshaler interface {
@@ -2,8 +2,11 @@ package borat
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
 	"reflect"
 	"testing"
 
@@ -130,40 +133,170 @@ func TestReadInt(t *testing.T) {
 			[]byte{0x39, 0x03, 0xe7},
 			-1000,
 		},
+		{
+			[]byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			-9223372036854775808,
+		},
+		{
+			[]byte{0x1b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			uint64(9223372036854775808),
+		},
+		{
+			[]byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			uint64(18446744073709551615),
+		},
 	}
 	for i := range testPatterns {
 		cborDecoderHarness(t, testPatterns[i].cbor, testPatterns[i].value)
 	}
+
+	// negative values beyond the int range are returned as big integers
+	r := NewCBORReader(bytes.NewReader([]byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	v, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := new(big.Int).SetString("-18446744073709551616", 10)
+	if b, ok := v.(*big.Int); !ok || b.Cmp(want) != 0 {
+		t.Errorf("expected %v, got %#v", want, v)
+	}
+
+	r = NewCBORReader(bytes.NewReader([]byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	if _, err := r.ReadInt(); err != IntegerOverflowError {
+		t.Errorf("expected %v from ReadInt, got %v", IntegerOverflowError, err)
+	}
 }
 
-// We do not support 16-bit floats at the moment. Test for expected functionality.
-func TestReadFloatUnsupported(t *testing.T) {
-	testPatterns := []struct {
+func TestUnmarshalIntegerRange(t *testing.T) {
+	var u64 uint64
+	r := NewCBORReader(bytes.NewReader([]byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}))
+	if err := r.Unmarshal(&u64); err != nil || u64 != math.MaxUint64-1 {
+		t.Errorf("expected %d, got %d (error %v)", uint64(math.MaxUint64-1), u64, err)
+	}
+
+	var i64 int64
+	r = NewCBORReader(bytes.NewReader([]byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	if err := r.Unmarshal(&i64); err != nil || i64 != math.MinInt64 {
+		t.Errorf("expected %d, got %d (error %v)", int64(math.MinInt64), i64, err)
+	}
+
+	overflows := []struct {
 		cbor []byte
-		err  error
+		dst  interface{}
+	}{
+		{[]byte{0x19, 0x01, 0x00}, new(uint8)},
+		{[]byte{0x18, 0x80}, new(int8)},
+		{[]byte{0x38, 0x80}, new(int8)},
+		{[]byte{0x20}, new(uint)},
+		{[]byte{0x1a, 0x80, 0x00, 0x00, 0x00}, new(int32)},
+		{[]byte{0x1b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, new(int64)},
+		{[]byte{0x3b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, new(int64)},
+		{[]byte{0xa1, 0x61, 0x41, 0x19, 0x01, 0x00}, &struct{ A uint8 }{}},
+		{[]byte{0xa1, 0x61, 0x41, 0x82, 0x01, 0x20}, &struct{ A []uint16 }{}},
+		{[]byte{0xa1, 0x19, 0x01, 0x2c, 0x01}, &map[int8]int{}},
+		{[]byte{0xa1, 0x20, 0x01}, &map[uint8]int{}},
+		{[]byte{0xa1, 0x61, 0x41, 0xa1, 0x20, 0x01}, &struct{ A map[uint8]int }{}},
+	}
+	for _, c := range overflows {
+		r := NewCBORReader(bytes.NewReader(c.cbor))
+		if err := r.Unmarshal(c.dst); !errors.Is(err, IntegerOverflowError) {
+			t.Errorf("unmarshaling % x into %T: expected overflow, got %v", c.cbor, c.dst, err)
+		}
+	}
+
+	var s struct {
+		A uint64
+		B int16
+		C []uint64
+	}
+	in := []byte{0xa3, 0x61, 0x41, 0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x61, 0x42, 0x39, 0x7f, 0xff, 0x61, 0x43, 0x82, 0x01, 0x1b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	r = NewCBORReader(bytes.NewReader(in))
+	if err := r.Unmarshal(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.A != math.MaxUint64 || s.B != math.MinInt16 || len(s.C) != 2 || s.C[0] != 1 || s.C[1] != 1<<63 {
+		t.Errorf("unexpected result %+v", s)
+	}
+
+	// floats are not truncated into integers, nor integers turned into runes
+	mismatches := []struct {
+		cbor []byte
+		dst  interface{}
+	}{
+		{[]byte{0xa1, 0x61, 0x41, 0xfb, 0x42, 0x02, 0xa0, 0x5f, 0x20, 0x00, 0x00, 0x00}, &struct{ A int8 }{}},
+		{[]byte{0x81, 0xf9, 0x3e, 0x00}, &[]uint{}},
+		{[]byte{0xa1, 0x61, 0x41, 0x18, 0x41}, &struct{ A string }{}},
+	}
+	for _, c := range mismatches {
+		if err := NewCBORReader(bytes.NewReader(c.cbor)).Unmarshal(c.dst); err == nil {
+			t.Errorf("unmarshaling % x into %T: expected error, got %v", c.cbor, c.dst, c.dst)
+		}
+	}
+}
+
+func TestReadFloatHalf(t *testing.T) {
+	testPatterns := []struct {
+		cbor  []byte
+		value float64
 	}{
 		{
-			// 0.0
 			[]byte{0xf9, 0x00, 0x00},
-			UnsupportedTypeReadError,
+			0.0,
 		},
 		{
-			// -0.0
 			[]byte{0xf9, 0x80, 0x00},
-			UnsupportedTypeReadError,
+			math.Copysign(0, -1),
+		},
+		{
+			[]byte{0xf9, 0x3c, 0x00},
+			1.0,
+		},
+		{
+			[]byte{0xf9, 0x3e, 0x00},
+			1.5,
 		},
 		{
-			// 65504.0
 			[]byte{0xf9, 0x7b, 0xff},
-			UnsupportedTypeReadError,
+			65504.0,
+		},
+		{
+			// smallest subnormal
+			[]byte{0xf9, 0x00, 0x01},
+			5.960464477539063e-08,
+		},
+		{
+			// smallest normal
+			[]byte{0xf9, 0x04, 0x00},
+			6.103515625e-05,
+		},
+		{
+			[]byte{0xf9, 0xc4, 0x00},
+			-4.0,
+		},
+		{
+			[]byte{0xf9, 0x7c, 0x00},
+			math.Inf(1),
+		},
+		{
+			[]byte{0xf9, 0xfc, 0x00},
+			math.Inf(-1),
 		},
 	}
 	for i := range testPatterns {
-		cborDecoderHarnessExpectErr(t, testPatterns[i].cbor, testPatterns[i].err)
+		cborDecoderHarness(t, testPatterns[i].cbor, testPatterns[i].value)
+	}
+
+	r := NewCBORReader(bytes.NewReader([]byte{0xf9, 0x80, 0x00}))
+	if f, err := r.ReadFloat(); err != nil || !math.Signbit(f) {
+		t.Errorf("expected negative zero but got %v, %v", f, err)
+	}
+	r = NewCBORReader(bytes.NewReader([]byte{0xf9, 0x7e, 0x00}))
+	if f, err := r.ReadFloat(); err != nil || !math.IsNaN(f) {
+		t.Errorf("expected NaN but got %v, %v", f, err)
 	}
 }
 
-// We only support IEEE754 single (32bit) or double (64bit) precision floats.
 func TestReadFloatSupported(t *testing.T) {
 	testPatterns := []struct {
 		cbor  []byte
@@ -258,6 +391,127 @@ func TestReadSlice(t *testing.T) {
 	}
 }
 
+func TestUnmarshalFloatSlice(t *testing.T) {
+	// [1.5, null, 2]
+	in := []byte{0x83, 0xf9, 0x3e, 0x00, 0xf6, 0x02}
+	var f []float64
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&f); err != nil || !reflect.DeepEqual(f, []float64{1.5, 0, 2}) {
+		t.Errorf("got %v (error %v)", f, err)
+	}
+	var s struct{ F []float32 }
+	in = []byte{0xa1, 0x61, 0x46, 0x82, 0xf6, 0x61, 0x61}
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&s); err == nil {
+		t.Errorf("expected error for string in float slice, got %v", s.F)
+	}
+}
+
+func TestReadIndefinite(t *testing.T) {
+	testPatterns := []struct {
+		cbor  []byte
+		value interface{}
+	}{
+		{
+			[]byte{0x5f, 0x42, 0x01, 0x02, 0x43, 0x03, 0x04, 0x05, 0xff},
+			[]byte{0x01, 0x02, 0x03, 0x04, 0x05},
+		},
+		{
+			[]byte{0x5f, 0xff},
+			[]byte{},
+		},
+		{
+			[]byte{0x7f, 0x65, 0x73, 0x74, 0x72, 0x65, 0x61, 0x64, 0x6d, 0x69, 0x6e, 0x67, 0xff},
+			"streaming",
+		},
+		{
+			[]byte{0x9f, 0xff},
+			[]interface{}{},
+		},
+		{
+			[]byte{0x9f, 0x01, 0x82, 0x02, 0x03, 0x9f, 0x04, 0x05, 0xff, 0xff},
+			[]interface{}{1, []interface{}{2, 3}, []interface{}{4, 5}},
+		},
+		{
+			[]byte{0x83, 0x01, 0x9f, 0x02, 0x03, 0xff, 0x82, 0x04, 0x05},
+			[]interface{}{1, []interface{}{2, 3}, []interface{}{4, 5}},
+		},
+		{
+			[]byte{0xbf, 0x61, 0x61, 0x01, 0x61, 0x62, 0x9f, 0x02, 0x03, 0xff, 0xff},
+			map[string]interface{}{
+				"a": 1,
+				"b": []interface{}{2, 3},
+			},
+		},
+		{
+			[]byte{0x82, 0x61, 0x61, 0xbf, 0x61, 0x62, 0x61, 0x63, 0xff},
+			[]interface{}{"a", map[string]interface{}{"b": "c"}},
+		},
+		{
+			[]byte{0xbf, 0x63, 0x46, 0x75, 0x6e, 0xf5, 0x63, 0x41, 0x6d, 0x74, 0x21, 0xff},
+			map[string]interface{}{
+				"Fun": true,
+				"Amt": -2,
+			},
+		},
+	}
+	for i := range testPatterns {
+		cborDecoderUntagHarness(t, testPatterns[i].cbor, testPatterns[i].value)
+	}
+
+	r := NewCBORReader(bytes.NewReader([]byte{0xbf, 0x01, 0x61, 0x61, 0x02, 0x61, 0x62, 0xff}))
+	m, err := r.ReadIntMap()
+	if err != nil {
+		t.Fatalf("failed to decode indefinite-length int map: %v", err)
+	}
+	if diff, equal := messagediff.PrettyDiff(r.UntagIntMap(m), map[int]interface{}{1: "a", 2: "b"}); !equal {
+		t.Errorf("decoder returned unexpected result: %#v diff=%s", m, diff)
+	}
+
+	r = NewCBORReader(bytes.NewReader([]byte{0x9f, 0x61, 0x61, 0x7f, 0x61, 0x62, 0x61, 0x63, 0xff, 0xff}))
+	sa, err := r.ReadStringArray()
+	if err != nil {
+		t.Fatalf("failed to decode indefinite-length string array: %v", err)
+	}
+	if diff, equal := messagediff.PrettyDiff(sa, []string{"a", "bc"}); !equal {
+		t.Errorf("decoder returned unexpected result: %#v diff=%s", sa, diff)
+	}
+}
+
+func TestReadIndefiniteInvalid(t *testing.T) {
+	testPatterns := []struct {
+		cbor []byte
+		err  error
+	}{
+		{
+			// break outside of an indefinite-length item
+			[]byte{0xff},
+			InvalidCBORError,
+		},
+		{
+			// text string chunk inside a byte string
+			[]byte{0x5f, 0x61, 0x61, 0xff},
+			InvalidCBORError,
+		},
+		{
+			// nested indefinite-length chunk
+			[]byte{0x7f, 0x7f, 0xff, 0xff},
+			InvalidCBORError,
+		},
+		{
+			// indefinite-length integer
+			[]byte{0x1f},
+			InvalidCBORError,
+		},
+		{
+			// missing break
+			[]byte{0x9f, 0x01, 0x02},
+			io.EOF,
+		},
+	}
+	for i := range testPatterns {
+		cborDecoderHarnessExpectErr(t, testPatterns[i].cbor, testPatterns[i].err)
+	}
+}
+
 func TestReadStringMap(t *testing.T) {
 	testPatterns := []struct {
 		cbor  []byte
@@ -348,3 +602,285 @@ func TestReadToStruct(t *testing.T) {
 		t.Errorf("failed unmarshaling struct, got=%+v, diff=%s", got, diff)
 	}
 }
+
+func TestReadToIntKeyedStruct(t *testing.T) {
+	data := []byte{
+		0xa3, 0x01, 0x1a, 0x00, 0x0f, 0x3d, 0xdd, 0x02,
+		0x6a, 0x73, 0x75, 0x72, 0x65, 0x77, 0x68, 0x79,
+		0x6e, 0x6f, 0x74, 0x03, 0xf4,
+	}
+	type A struct {
+		NumericValue int    `cbor:"#1"`
+		StringValue  string `cbor:"#2"`
+		BooleanValue bool   `cbor:"#3"`
+	}
+	want := &A{998877, "surewhynot", false}
+	got := &A{}
+	r := NewCBORReader(bytes.NewReader(data))
+	if err := r.Unmarshal(got); err != nil {
+		t.Errorf("expected nil error from unmarshal but got: %v", err)
+	}
+	if ok := reflect.DeepEqual(want, got); !ok {
+		t.Errorf("failed unmarshaling struct: want %+v, got %+v", want, got)
+	}
+
+	// Keys which are not integers match no field and are skipped.
+	r = NewCBORReader(bytes.NewReader([]byte{0xa2, 0x61, 0x31, 0x81, 0x01, 0x03, 0xf5}))
+	got = &A{}
+	if err := r.Unmarshal(got); err != nil || !got.BooleanValue {
+		t.Errorf("expected string key to be skipped, got %+v (error %v)", got, err)
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	cases := []struct {
+		name  string
+		in    []byte
+		setup func(r *CBORReader)
+		err   error
+	}{
+		{"message", []byte{0x83, 0x01, 0x02, 0x03}, func(r *CBORReader) { r.SetMessageLimit(3) }, MessageLimitError},
+		{"message string", []byte{0x44, 0x01, 0x02, 0x03, 0x04}, func(r *CBORReader) { r.SetMessageLimit(4) }, MessageLimitError},
+		{"string", []byte{0x63, 0x61, 0x62, 0x63}, func(r *CBORReader) { r.SetStringLimit(2) }, StringLimitError},
+		{"string chunks", []byte{0x7f, 0x62, 0x61, 0x62, 0x61, 0x63, 0xff}, func(r *CBORReader) { r.SetStringLimit(2) }, StringLimitError},
+		{"huge string head", []byte{0x5b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, func(r *CBORReader) { r.SetStringLimit(1024) }, StringLimitError},
+		{"array", []byte{0x83, 0x01, 0x02, 0x03}, func(r *CBORReader) { r.SetElementLimit(2) }, ElementLimitError},
+		{"indefinite array", []byte{0x9f, 0x01, 0x02, 0x03, 0xff}, func(r *CBORReader) { r.SetElementLimit(2) }, ElementLimitError},
+		{"map", []byte{0xa2, 0x01, 0x02, 0x03, 0x04}, func(r *CBORReader) { r.SetElementLimit(1) }, ElementLimitError},
+		{"depth", []byte{0x81, 0x81, 0x81, 0x01}, func(r *CBORReader) { r.SetDepthLimit(2) }, DepthLimitError},
+		{"depth map", []byte{0xa1, 0x61, 0x61, 0xa1, 0x01, 0x80}, func(r *CBORReader) { r.SetDepthLimit(2) }, DepthLimitError},
+	}
+	for _, c := range cases {
+		r := NewCBORReader(bytes.NewReader(c.in))
+		c.setup(r)
+		if _, err := r.Read(); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	// within the limits everything reads as usual
+	r := NewCBORReader(bytes.NewReader([]byte{0x82, 0x81, 0x01, 0x62, 0x61, 0x62}))
+	r.SetMessageLimit(6)
+	r.SetStringLimit(2)
+	r.SetElementLimit(2)
+	r.SetDepthLimit(2)
+	if _, err := r.Read(); err != nil {
+		t.Errorf("expected no error within limits, got %v", err)
+	}
+}
+
+func TestReadTagDepth(t *testing.T) {
+	// a long chain of tags must hit the depth limit rather than the stack
+	in := append([]byte{0x81}, bytes.Repeat([]byte{0xc6}, 1<<20)...)
+	r := NewCBORReader(bytes.NewReader(in))
+	r.SetDepthLimit(16)
+	if _, err := r.ReadArray(); err != DepthLimitError {
+		t.Errorf("ReadArray: expected %v, got %v", DepthLimitError, err)
+	}
+	r = NewCBORReader(bytes.NewReader(in))
+	r.SetDepthLimit(16)
+	if err := r.Skip(); err != DepthLimitError {
+		t.Errorf("Skip: expected %v, got %v", DepthLimitError, err)
+	}
+
+	// tags within the limit read as usual
+	r = NewCBORReader(bytes.NewReader([]byte{0x81, 0xc6, 0xc6, 0x01}))
+	r.SetDepthLimit(3)
+	if _, err := r.ReadArray(); err != nil {
+		t.Errorf("expected no error within limits, got %v", err)
+	}
+}
+
+func TestReadHugeStringHead(t *testing.T) {
+	// a header claiming far more data than is sent must not be trusted
+	in := []byte{0x5b, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02}
+	r := NewCBORReader(bytes.NewReader(in))
+	if _, err := r.ReadBytes(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestReadSelfDescribe(t *testing.T) {
+	in := []byte{
+		0xd9, 0xd9, 0xf7, 0x01,
+		0xd9, 0xd9, 0xf7, 0xd9, 0xd9, 0xf7, 0x82, 0xd9, 0xd9, 0xf7, 0x02, 0xd9, 0x03, 0xe8, 0x03,
+		0xd9, 0xd9, 0xf7, 0xa1, 0x61, 0x41, 0xd9, 0xd9, 0xf7, 0x04,
+	}
+	r := NewCBORReader(bytes.NewReader(in))
+	if i, err := r.ReadInt(); err != nil || i != 1 {
+		t.Errorf("expected 1, got %v (error %v)", i, err)
+	}
+	v, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TaggedElement{{Value: 2}, {Tag: 1000, Value: 3}}
+	if diff, equal := messagediff.PrettyDiff(v, expected); !equal {
+		t.Errorf("unexpected result: %#v diff=%s", v, diff)
+	}
+	var s struct{ A int }
+	if err := r.Unmarshal(&s); err != nil || s.A != 4 {
+		t.Errorf("expected 4, got %v (error %v)", s.A, err)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestPeekType(t *testing.T) {
+	in := []byte{0xd9, 0xd9, 0xf7, 0x9f, 0x18, 0x64, 0x3a, 0x00, 0x01, 0x86, 0xa0, 0xff}
+	r := NewCBORReader(bytes.NewReader(in))
+	for i := 0; i < 2; i++ {
+		if mt, ai, err := r.PeekType(); err != nil || mt != MajorTypeArray || ai != 31 {
+			t.Errorf("expected array with indefinite length, got %v %d (error %v)", mt, ai, err)
+		}
+	}
+	v, err := r.ReadIntArray()
+	if err != nil || !reflect.DeepEqual(v, []int{100, -100001}) {
+		t.Errorf("unexpected result %v (error %v)", v, err)
+	}
+	if _, _, err := r.PeekType(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	items := [][]byte{
+		{0x1b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+		{0x5f, 0x42, 0x01, 0x02, 0x41, 0x03, 0xff},
+		append([]byte{0x78, 0x41}, bytes.Repeat([]byte{0x61}, 65)...),
+		{0xbf, 0x61, 0x61, 0x9f, 0x01, 0x82, 0x02, 0x03, 0xff, 0x01, 0xa0, 0xff},
+		{0xc1, 0xfb, 0x41, 0xd4, 0x52, 0xd9, 0xec, 0x20, 0x00, 0x00},
+		{0xf8, 0x20},
+	}
+	var in []byte
+	for _, item := range items {
+		in = append(in, item...)
+	}
+	in = append(in, 0x07)
+
+	src := bytes.NewReader(in)
+	r := NewCBORReader(src)
+	for _, item := range items {
+		start := r.offset
+		if err := r.Skip(); err != nil {
+			t.Fatalf("Skip(% x) failed: %v", item, err)
+		}
+		if n := r.offset - start; n != int64(len(item)) {
+			t.Errorf("Skip(% x) consumed %d bytes", item, n)
+		}
+	}
+	if i, err := r.ReadInt(); err != nil || i != 7 {
+		t.Errorf("expected 7 after skipped items, got %v (error %v)", i, err)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		src.Reset(in)
+		r.offset = 0
+		for range items {
+			if err := r.Skip(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Skip allocated %v times", allocs)
+	}
+
+	for _, bad := range [][]byte{{0xff}, {0x82, 0x01}, {0x5f, 0x61, 0x61, 0xff}, {0xfc}} {
+		if err := NewCBORReader(bytes.NewReader(bad)).Skip(); err == nil {
+			t.Errorf("Skip(% x): expected error", bad)
+		}
+	}
+}
+
+func TestUnmarshalSkipsUnknownKeys(t *testing.T) {
+	// {"Extra": [{"deep": h'0102'}], "A": 1} with an invalid URI in the
+	// unknown field, which is skipped without being decoded
+	in := []byte{0xa2, 0x65, 0x45, 0x78, 0x74, 0x72, 0x61, 0x81, 0xa1, 0x64, 0x64, 0x65, 0x65, 0x70,
+		0xd8, 0x20, 0x42, 0x01, 0x02, 0x61, 0x41, 0x01}
+	var s struct{ A int }
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&s); err != nil || s.A != 1 {
+		t.Errorf("expected 1, got %v (error %v)", s.A, err)
+	}
+
+	// {1("A"): 1, 1000(["X"]): 0, "B": 2} has tagged keys, which are read whole
+	in = []byte{0xa3, 0xc1, 0x61, 0x41, 0x01, 0xd9, 0x03, 0xe8, 0x81, 0x61, 0x58, 0x00, 0x61, 0x42, 0x02}
+	r := NewCBORReader(bytes.NewReader(in))
+	var ab struct{ A, B int }
+	if err := r.Unmarshal(&ab); err != nil || ab.A != 1 || ab.B != 2 {
+		t.Errorf("expected {1 2}, got %+v (error %v)", ab, err)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("expected end of input, got %v", err)
+	}
+}
+
+func TestUnmarshalTaggedNull(t *testing.T) {
+	// 1000(null) in a struct field, an array element and a map value
+	cases := []struct {
+		cbor []byte
+		dst  interface{}
+	}{
+		{[]byte{0xa1, 0x61, 0x41, 0xd9, 0x03, 0xe8, 0xf6}, &struct{ A int }{}},
+		{[]byte{0xa1, 0x61, 0x41, 0xd9, 0x03, 0xe8, 0xf6}, &struct{ A *string }{}},
+		{[]byte{0x81, 0xd9, 0x03, 0xe8, 0xf6}, &[1]string{}},
+		{[]byte{0xa1, 0x61, 0x41, 0xd9, 0x03, 0xe8, 0xf6}, &map[string]int{}},
+	}
+	for _, c := range cases {
+		if err := NewCBORReader(bytes.NewReader(c.cbor)).Unmarshal(c.dst); err == nil {
+			t.Errorf("unmarshaling % x into %T: expected error", c.cbor, c.dst)
+		}
+	}
+
+	var v struct{ A interface{} }
+	if err := NewCBORReader(bytes.NewReader(cases[0].cbor)).Unmarshal(&v); err != nil || v.A != nil {
+		t.Errorf("expected tagged null to leave interface unset, got %v (error %v)", v.A, err)
+	}
+}
+
+func TestReadSimple(t *testing.T) {
+	in := []byte{0xf0, 0xf7, 0xf8, 0xff, 0xf4, 0x82, 0xf8, 0x20, 0xf7, 0xf7}
+	r := NewCBORReader(bytes.NewReader(in))
+	if v, err := r.ReadSimple(); err != nil || v != 16 {
+		t.Errorf("expected simple value 16, got %v (error %v)", v, err)
+	}
+	if v, err := r.Read(); err != nil || v != Undefined {
+		t.Errorf("expected undefined, got %v (error %v)", v, err)
+	}
+	var sv SimpleValue
+	if err := r.Unmarshal(&sv); err != nil || sv != 255 {
+		t.Errorf("expected simple value 255, got %v (error %v)", sv, err)
+	}
+	if v, err := r.ReadSimple(); err != nil || v != 20 {
+		t.Errorf("expected simple value 20 for false, got %v (error %v)", v, err)
+	}
+	v, err := r.Read()
+	expected := []TaggedElement{{Value: SimpleValue(32)}, {Value: Undefined}}
+	if diff, equal := messagediff.PrettyDiff(v, expected); err != nil || !equal {
+		t.Errorf("unexpected result: %#v (error %v) diff=%s", v, err, diff)
+	}
+	var s struct{ A SimpleValue }
+	if err := NewCBORReader(bytes.NewReader([]byte{0xa1, 0x61, 0x41, 0xf7})).Unmarshal(&s); err != nil || s.A != Undefined {
+		t.Errorf("expected undefined, got %v (error %v)", s.A, err)
+	}
+
+	if _, err := NewCBORReader(bytes.NewReader([]byte{0xf9, 0x3c, 0x00})).ReadSimple(); err != CBORTypeReadError {
+		t.Errorf("expected type error reading float as simple value, got %v", err)
+	}
+	r = NewCBORReader(bytes.NewReader([]byte{0xf8, 0x20}))
+	if _, err := r.ReadFloat(); err != CBORTypeReadError {
+		t.Errorf("expected type error reading simple value as float, got %v", err)
+	}
+	if v, err := r.ReadSimple(); err != nil || v != 32 {
+		t.Errorf("expected simple value 32 after failed float read, got %v (error %v)", v, err)
+	}
+	for _, bad := range [][]byte{{0xf8, 0x00}, {0xf8, 0x18}, {0xf8, 0x1f}} {
+		if _, err := NewCBORReader(bytes.NewReader(bad)).Read(); err != InvalidCBORError {
+			t.Errorf("Read(% x): expected invalid CBOR, got %v", bad, err)
+		}
+		if err := NewCBORReader(bytes.NewReader(bad)).Skip(); err != InvalidCBORError {
+			t.Errorf("Skip(% x): expected invalid CBOR, got %v", bad, err)
+		}
+	}
+}
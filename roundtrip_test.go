@@ -2,8 +2,15 @@ package borat
 
 import (
 	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"gopkg.in/d4l3k/messagediff.v1"
 )
@@ -130,3 +137,1464 @@ func TestRoundtripStructs(t *testing.T) {
 		t.Errorf("structs differ, diff: %v", diff)
 	}
 }
+
+type Celsius float64
+
+type Floats struct {
+	A float64
+	B float32
+	C []float64
+	D [2]float32
+	E Celsius
+	F []Celsius
+	G ConvolutedFloat
+}
+
+type ConvolutedFloat interface{}
+
+func TestRoundtripFloats(t *testing.T) {
+	s := Floats{
+		A: 1.1,
+		B: 1.5,
+		C: []float64{0.25, -4.1, 100000},
+		D: [2]float32{65504, -0.5},
+		E: Celsius(21.5),
+		F: []Celsius{-40, 37.2},
+		G: Celsius(-273.15),
+	}
+	for _, pref := range []FloatPref{FloatPrefDouble, FloatPrefShortest} {
+		buf := bytes.NewBuffer([]byte{})
+		writer := NewCBORWriter(buf)
+		writer.SetFloatPref(pref)
+		writer.RegisterCBORTag(0xee, Celsius(0))
+		reader := NewCBORReader(buf)
+		reader.RegisterCBORTag(0xee, Celsius(0))
+		if err := writer.Marshal(s); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var e Floats
+		if err := reader.Unmarshal(&e); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if diff, ok := messagediff.PrettyDiff(e, s); !ok {
+			t.Errorf("structs differ, diff: %v", diff)
+		}
+
+		if err := writer.Marshal(Celsius(-12.5)); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var c Celsius
+		if err := reader.Unmarshal(&c); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if c != -12.5 {
+			t.Errorf("got %v, want %v", c, -12.5)
+		}
+	}
+}
+
+func TestUnmarshalIntToFloat(t *testing.T) {
+	type A struct {
+		F float64
+		G []float32
+	}
+	buf := bytes.NewBuffer([]byte{})
+	writer := NewCBORWriter(buf)
+	if err := writer.WriteStringMap(map[string]interface{}{"F": 7, "G": []int{-3, 4}}); err != nil {
+		t.Fatalf("WriteStringMap failed: %v", err)
+	}
+	if err := writer.WriteInt(-1000); err != nil {
+		t.Fatalf("WriteInt failed: %v", err)
+	}
+	reader := NewCBORReader(buf)
+	var a A
+	if err := reader.Unmarshal(&a); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, ok := messagediff.PrettyDiff(a, A{F: 7, G: []float32{-3, 4}}); !ok {
+		t.Errorf("structs differ, diff: %v", diff)
+	}
+	var f float32
+	if err := reader.Unmarshal(&f); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if f != -1000 {
+		t.Errorf("got %v, want %v", f, -1000)
+	}
+}
+
+type Maps struct {
+	A map[string]int
+	B map[int]string
+	C map[uint8][]string
+	D map[string]Two
+	E map[string]interface{}
+	F []map[string]bool
+	G map[bool]float64
+	H map[float64]int
+}
+
+func TestRoundtripMaps(t *testing.T) {
+	s := Maps{
+		A: map[string]int{"one": 1, "two": 2, "minus three": -3},
+		B: map[int]string{-1: "minus one", 0: "zero", 100: "hundred"},
+		C: map[uint8][]string{7: []string{"a", "b"}, 8: []string{}},
+		D: map[string]Two{"x": Two{"First"}, "y": Two{"Second"}},
+		E: map[string]interface{}{"s": "hi", "i": 42, "l": []interface{}{"a", 1}},
+		F: []map[string]bool{map[string]bool{"t": true}, map[string]bool{"f": false}},
+		G: map[bool]float64{true: 1.5, false: -0.5},
+		H: map[float64]int{1.5: 1, -2.25: 2},
+	}
+	buf := bytes.NewBuffer([]byte{})
+	writer := NewCBORWriter(buf)
+	reader := NewCBORReader(buf)
+	if err := writer.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var e Maps
+	if err := reader.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, ok := messagediff.PrettyDiff(e, s); !ok {
+		t.Errorf("structs differ, diff: %v", diff)
+	}
+
+	m := map[int16][]int{-300: []int{1}, 2: []int{2, 3}}
+	if err := writer.Marshal(m); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var got map[int16][]int
+	if err := reader.Unmarshal(&got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, ok := messagediff.PrettyDiff(got, m); !ok {
+		t.Errorf("maps differ, diff: %v", diff)
+	}
+
+	u := map[uint64]int{1 << 63: 1, math.MaxUint64: 2, 3: 3}
+	if err := writer.Marshal(u); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var gotU map[uint64]int
+	if err := reader.Unmarshal(&gotU); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, ok := messagediff.PrettyDiff(gotU, u); !ok {
+		t.Errorf("maps differ, diff: %v", diff)
+	}
+}
+
+func TestMarshalMapUnsupportedKey(t *testing.T) {
+	writer := NewCBORWriter(bytes.NewBuffer([]byte{}))
+	if err := writer.Marshal(map[Two]int{Two{"a"}: 1}); err == nil {
+		t.Errorf("expected an error marshaling a map with struct keys")
+	}
+}
+
+func TestMarshalMapNaNKey(t *testing.T) {
+	maps := []interface{}{
+		map[float64]int{math.NaN(): 1},
+		map[float32]int{1: 1, float32(math.NaN()): 2},
+		map[interface{}]int{"a": 1, math.NaN(): 2},
+	}
+	for _, m := range maps {
+		writer := NewCBORWriter(bytes.NewBuffer([]byte{}))
+		if err := writer.Marshal(m); err == nil {
+			t.Errorf("expected an error marshaling %v with a NaN key", m)
+		}
+	}
+}
+
+type Compact struct {
+	A uint64                   `cbor:"#1"`
+	B string                   `cbor:"#2"`
+	C [4]byte                  `cbor:"#3"`
+	D []string                 `cbor:"#4"`
+	E []Two                    `cbor:"#5"`
+	F []*CompactInner          `cbor:"#6"`
+	G ConvolutedIndirectable   `cbor:"#7"`
+	H []ConvolutedIndirectable `cbor:"#8"`
+	I IntTypedef               `cbor:"#9"`
+	J []CompactInner           `cbor:"#10"`
+	K map[int]CompactInner     `cbor:"#-1"`
+	L CompactInner             `cbor:"#0"`
+	m int
+}
+
+type CompactInner struct {
+	X int    `cbor:"#1"`
+	Y string `cbor:"#2"`
+}
+
+func TestRoundtripIntKeyedStructs(t *testing.T) {
+	s := Compact{
+		A: 1234,
+		B: "Hello",
+		C: [4]byte{0xC, 0xA, 0xF, 0xE},
+		D: []string{"Lorem", "Ipsum"},
+		E: []Two{Two{"First"}, Two{"Second"}},
+		F: []*CompactInner{&CompactInner{-5, "pointer"}},
+		G: Indirector{1},
+		H: []ConvolutedIndirectable{&Indirector{21}, &Indirector{31}},
+		I: IntTypedef(32),
+		J: []CompactInner{CompactInner{1, "a"}, CompactInner{2, "b"}},
+		K: map[int]CompactInner{-3: CompactInner{3, "c"}},
+		L: CompactInner{4, "d"},
+	}
+	buf := bytes.NewBuffer([]byte{})
+	writer := NewCBORWriter(buf)
+	writer.RegisterCBORTag(0xaa, Two{})
+	writer.RegisterCBORTag(0xbb, &Indirector{})
+	writer.RegisterCBORTag(0xcc, uint8(0))
+	writer.RegisterCBORTag(0xdd, Indirector{})
+	reader := NewCBORReader(buf)
+	reader.RegisterCBORTag(0xaa, Two{})
+	reader.RegisterCBORTag(0xbb, &Indirector{})
+	reader.RegisterCBORTag(0xcc, uint8(0))
+	reader.RegisterCBORTag(0xdd, Indirector{})
+	if err := writer.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var e Compact
+	if err := reader.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, ok := messagediff.PrettyDiff(e, s); !ok {
+		t.Errorf("structs differ, diff: %v", diff)
+	}
+}
+
+type SelfTagged struct {
+	cborTag struct{} `cbor:"1234"`
+	A       int
+}
+
+func (s SelfTagged) ConvolutedIndirection() int { return s.A }
+
+type SelfTaggedHolder struct {
+	S SelfTagged
+	T []SelfTagged
+	U ConvolutedIndirectable
+}
+
+func TestSelfTaggedStructs(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	writer := NewCBORWriter(buf)
+	if err := writer.Marshal(SelfTagged{A: 1}); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	want := []byte{0xd9, 0x04, 0xd2, 0xa1, 0x61, 0x41, 0x01}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("expected [% x], got [% x]", want, buf.Bytes())
+	}
+	reader := NewCBORReader(buf)
+	var s SelfTagged
+	if err := reader.Unmarshal(&s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if s.A != 1 {
+		t.Errorf("got %v, want %v", s.A, 1)
+	}
+
+	h := SelfTaggedHolder{
+		S: SelfTagged{A: 2},
+		T: []SelfTagged{SelfTagged{A: 3}},
+		U: SelfTagged{A: 4},
+	}
+	if err := writer.Marshal(h); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := reader.RegisterTaggedStruct(SelfTagged{}); err != nil {
+		t.Fatalf("RegisterTaggedStruct failed: %v", err)
+	}
+	var e SelfTaggedHolder
+	if err := reader.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, ok := messagediff.PrettyDiff(e, h); !ok {
+		t.Errorf("structs differ, diff: %v", diff)
+	}
+
+	// A struct with the wrong tag is rejected.
+	buf.Write([]byte{0xd9, 0x04, 0xd3, 0xa1, 0x61, 0x41, 0x01})
+	if err := reader.Unmarshal(&s); err == nil {
+		t.Errorf("expected an error unmarshaling a struct with the wrong tag")
+	}
+	if err := reader.RegisterTaggedStruct(Two{}); err == nil {
+		t.Errorf("expected an error registering a struct without cborTag")
+	}
+
+	// A registered self-tagged struct is tagged exactly once, even when zero.
+	if err := writer.RegisterCBORTag(1234, SelfTagged{}); err != nil {
+		t.Fatalf("RegisterCBORTag failed: %v", err)
+	}
+	for _, v := range []SelfTagged{{}, {A: 1}} {
+		buf.Reset()
+		if err := writer.Marshal(v); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		want := []byte{0xd9, 0x04, 0xd2, 0xa1, 0x61, 0x41, byte(v.A)}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("expected [% x], got [% x]", want, buf.Bytes())
+		}
+	}
+}
+
+type BigInts struct {
+	A *big.Int
+	B big.Int
+	C []*big.Int
+	D *big.Int `cbor:"d"`
+}
+
+func TestRoundtripBigInts(t *testing.T) {
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	negHuge := new(big.Int).Neg(huge)
+	s := BigInts{
+		A: huge,
+		B: *big.NewInt(-42),
+		C: []*big.Int{big.NewInt(7), negHuge, big.NewInt(1 << 40)},
+		D: big.NewInt(0),
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := NewCBORWriter(buf).Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var e BigInts
+	if err := NewCBORReader(buf).Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if e.A.Cmp(s.A) != 0 || e.B.Cmp(&s.B) != 0 || e.D.Cmp(s.D) != 0 || len(e.C) != len(s.C) {
+		t.Fatalf("got %v, want %v", e, s)
+	}
+	for i := range s.C {
+		if e.C[i].Cmp(s.C[i]) != 0 {
+			t.Errorf("C[%d]: got %v, want %v", i, e.C[i], s.C[i])
+		}
+	}
+
+	// values on either side of the 64 bit boundary
+	for _, v := range []string{"18446744073709551615", "18446744073709551616", "-18446744073709551616", "-18446744073709551617"} {
+		want, _ := new(big.Int).SetString(v, 10)
+		buf := bytes.NewBuffer([]byte{})
+		if err := NewCBORWriter(buf).Marshal(want); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		got := new(big.Int)
+		if err := NewCBORReader(buf).Unmarshal(got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if got.Cmp(want) != 0 {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+type Prices struct {
+	Net   Decimal
+	Gross *Decimal
+	Items []Decimal
+	Ratio *big.Float
+	Exact big.Float
+}
+
+func TestRoundtripDecimals(t *testing.T) {
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	ratio, _ := new(big.Float).SetPrec(200).SetString("0.1")
+	s := Prices{
+		Net:   Decimal{Mantissa: big.NewInt(1999), Exponent: -2},
+		Gross: &Decimal{Mantissa: huge, Exponent: -20},
+		Items: []Decimal{{Mantissa: big.NewInt(5), Exponent: 3}, {Mantissa: big.NewInt(0), Exponent: 0}},
+		Ratio: ratio,
+		Exact: *big.NewFloat(-1234.5e-10),
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := NewCBORWriter(buf).Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var e Prices
+	if err := NewCBORReader(buf).Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	equalDecimal := func(a, b Decimal) bool {
+		return a.Exponent == b.Exponent && a.Mantissa.Cmp(b.Mantissa) == 0
+	}
+	if !equalDecimal(e.Net, s.Net) || e.Gross == nil || !equalDecimal(*e.Gross, *s.Gross) {
+		t.Errorf("got %v and %v, want %v and %v", e.Net, e.Gross, s.Net, s.Gross)
+	}
+	if len(e.Items) != len(s.Items) {
+		t.Fatalf("got %v, want %v", e.Items, s.Items)
+	}
+	for i := range s.Items {
+		if !equalDecimal(e.Items[i], s.Items[i]) {
+			t.Errorf("Items[%d]: got %v, want %v", i, e.Items[i], s.Items[i])
+		}
+	}
+	if e.Ratio.Cmp(s.Ratio) != 0 || e.Exact.Cmp(&s.Exact) != 0 {
+		t.Errorf("got %v and %v, want %v and %v", e.Ratio, &e.Exact, s.Ratio, &s.Exact)
+	}
+
+	// explicit methods
+	buf.Reset()
+	w := NewCBORWriter(buf)
+	if err := w.WriteDecimal(s.Net); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBigFloat(s.Ratio); err != nil {
+		t.Fatal(err)
+	}
+	r := NewCBORReader(buf)
+	if d, err := r.ReadDecimal(); err != nil || !equalDecimal(d, s.Net) {
+		t.Errorf("ReadDecimal: got %v (error %v), want %v", d, err, s.Net)
+	}
+	if f, err := r.ReadBigFloat(); err != nil || f.Cmp(s.Ratio) != 0 {
+		t.Errorf("ReadBigFloat: got %v (error %v), want %v", f, err, s.Ratio)
+	}
+
+	// indefinite-length arrays are accepted alike at the top level and in fields
+	indef := []byte{0xc4, 0x9f, 0x21, 0x19, 0x6a, 0xb3, 0xff}
+	want := Decimal{Mantissa: big.NewInt(27315), Exponent: -2}
+	if d, err := NewCBORReader(bytes.NewReader(indef)).ReadDecimal(); err != nil || !equalDecimal(d, want) {
+		t.Errorf("ReadDecimal: got %v (error %v), want %v", d, err, want)
+	}
+	var d Decimal
+	if err := NewCBORReader(bytes.NewReader(indef)).Unmarshal(&d); err != nil || !equalDecimal(d, want) {
+		t.Errorf("Unmarshal: got %v (error %v), want %v", d, err, want)
+	}
+	var p Prices
+	field := append([]byte{0xa1, 0x63, 'N', 'e', 't'}, indef...)
+	if err := NewCBORReader(bytes.NewReader(field)).Unmarshal(&p); err != nil || !equalDecimal(p.Net, want) {
+		t.Errorf("Unmarshal: got %v (error %v), want %v", p.Net, err, want)
+	}
+	for _, in := range [][]byte{
+		{0xc4, 0x9f, 0x21, 0xff},
+		{0xc4, 0x9f, 0x21, 0x01, 0x02, 0xff},
+	} {
+		if _, err := NewCBORReader(bytes.NewReader(in)).ReadDecimal(); err == nil {
+			t.Errorf("ReadDecimal: expected an error reading % x", in)
+		}
+	}
+}
+
+type Timestamps struct {
+	Created time.Time
+	Seen    []time.Time
+}
+
+func TestRoundtripTime(t *testing.T) {
+	s := Timestamps{
+		Created: time.Date(2021, 6, 1, 12, 30, 15, 123456789, time.FixedZone("CEST", 2*3600)),
+		Seen: []time.Time{
+			time.Date(1969, 12, 31, 23, 59, 58, 250000000, time.UTC),
+			time.Date(2038, 1, 19, 3, 14, 8, 0, time.UTC),
+		},
+	}
+
+	tests := []struct {
+		pref      DateTimePref
+		precision time.Duration
+	}{
+		{DateTimePrefInt, time.Second},
+		{DateTimePrefFloat, time.Microsecond},
+		{DateTimePrefString, time.Nanosecond},
+	}
+	for _, test := range tests {
+		buf := bytes.NewBuffer([]byte{})
+		w := NewCBORWriter(buf)
+		w.SetDateTimePref(test.pref)
+		if err := w.Marshal(s); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if err := w.Marshal(s.Created); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+
+		r := NewCBORReader(buf)
+		var e Timestamps
+		if err := r.Unmarshal(&e); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		var created time.Time
+		if err := r.Unmarshal(&created); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+
+		near := func(got, want time.Time) bool {
+			want = want.Truncate(test.precision)
+			d := got.Sub(want)
+			return d > -test.precision && d < test.precision
+		}
+		if !near(e.Created, s.Created) || !near(created, s.Created) {
+			t.Errorf("pref %d: got %v and %v, want %v", test.pref, e.Created, created, s.Created)
+		}
+		for i := range s.Seen {
+			if i >= len(e.Seen) || !near(e.Seen[i], s.Seen[i]) {
+				t.Errorf("pref %d: got %v, want %v", test.pref, e.Seen, s.Seen)
+				break
+			}
+		}
+		if test.pref == DateTimePrefString && (!e.Created.Equal(s.Created) || created.Format(time.RFC3339Nano) != s.Created.Format(time.RFC3339Nano)) {
+			t.Errorf("string timestamps should round-trip exactly, got %v", created)
+		}
+	}
+}
+
+func TestReadTimeFloat(t *testing.T) {
+	// 1363896240.5 and -1.25 as doubles with tag 1
+	in := []byte{0xc1, 0xfb, 0x41, 0xd4, 0x52, 0xd9, 0xec, 0x20, 0x00, 0x00,
+		0xc1, 0xf9, 0xbd, 0x00}
+	r := NewCBORReader(bytes.NewReader(in))
+	for _, want := range []time.Time{time.Unix(1363896240, 500000000), time.Unix(-2, 750000000)} {
+		got, err := r.ReadTime()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+type Record struct {
+	Born     Date
+	Holidays []Date
+	Updated  time.Time
+}
+
+func TestRoundtripDates(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	s := Record{
+		Born:     Date{1940, time.October, 9},
+		Holidays: []Date{{1969, time.December, 31}, {2024, time.February, 29}},
+		Updated:  time.Date(2023, 7, 14, 9, 30, 0, 987654321, berlin),
+	}
+
+	for _, pref := range []DateTimePref{DateTimePrefString, DateTimePrefExtended} {
+		buf := bytes.NewBuffer([]byte{})
+		w := NewCBORWriter(buf)
+		w.SetDateTimePref(pref)
+		if err := w.Marshal(s); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if err := w.Marshal(s.Born); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+
+		r := NewCBORReader(buf)
+		var e Record
+		if err := r.Unmarshal(&e); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		var born Date
+		if err := r.Unmarshal(&born); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if e.Born != s.Born || born != s.Born || !reflect.DeepEqual(e.Holidays, s.Holidays) {
+			t.Errorf("pref %d: got %v, %v and %v", pref, e.Born, born, e.Holidays)
+		}
+		if !e.Updated.Equal(s.Updated) {
+			t.Errorf("pref %d: got %v, want %v", pref, e.Updated, s.Updated)
+		}
+		if pref == DateTimePrefExtended && e.Updated.Location().String() != "Europe/Berlin" {
+			t.Errorf("expected the time zone hint to be kept, got %v", e.Updated.Location())
+		}
+	}
+
+	// an unset date is left out of a struct, and written as null elsewhere
+	for _, pref := range []DateTimePref{DateTimePrefInt, DateTimePrefString} {
+		buf := bytes.NewBuffer([]byte{})
+		w := NewCBORWriter(buf)
+		w.SetDateTimePref(pref)
+		unset := struct {
+			Born Date
+			Days []Date
+		}{Days: []Date{{}, s.Born}}
+		if err := w.Marshal(unset); err != nil {
+			t.Fatalf("pref %d: Marshal failed: %v", pref, err)
+		}
+		e := unset
+		e.Days = nil
+		if err := NewCBORReader(buf).Unmarshal(&e); err != nil || e.Born != (Date{}) || !reflect.DeepEqual(e.Days, unset.Days) {
+			t.Errorf("pref %d: got %+v (error %v), want %+v", pref, e, err, unset)
+		}
+		if err := w.WriteDate(Date{}); err == nil {
+			t.Errorf("pref %d: expected an error writing the zero date", pref)
+		}
+
+		buf.Reset()
+		if err := w.Marshal(Date{}); err != nil {
+			t.Fatalf("pref %d: Marshal failed: %v", pref, err)
+		}
+		born := s.Born
+		if err := NewCBORReader(buf).Unmarshal(&born); err != nil || born != (Date{}) {
+			t.Errorf("pref %d: got %v (error %v), want the zero date", pref, born, err)
+		}
+	}
+}
+
+func TestReadExtendedDates(t *testing.T) {
+	in := []byte{
+		// 1001({1: 1363896240, -12: 500000000000}) from RFC 9581
+		0xd9, 0x03, 0xe9, 0xa2, 0x01, 0x1a, 0x51, 0x4b, 0x67, 0xb0, 0x2b, 0x1b, 0x00, 0x00, 0x00, 0x74, 0x6a, 0x52, 0x88, 0x00,
+		// 100(-90) from RFC 8943
+		0xd8, 0x64, 0x38, 0x59,
+		// 1004("1940-10-09")
+		0xd9, 0x03, 0xec, 0x6a, '1', '9', '4', '0', '-', '1', '0', '-', '0', '9',
+	}
+	r := NewCBORReader(bytes.NewReader(in))
+	want := []time.Time{
+		time.Unix(1363896240, 500000000),
+		time.Date(1969, 10, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(1940, 10, 9, 0, 0, 0, 0, time.UTC),
+	}
+	for _, w := range want {
+		got, err := r.ReadTime()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(w) {
+			t.Errorf("got %v, want %v", got, w)
+		}
+	}
+
+	// unknown critical keys are rejected
+	r = NewCBORReader(bytes.NewReader([]byte{0xd9, 0x03, 0xe9, 0xa2, 0x01, 0x00, 0x24, 0x00}))
+	if _, err := r.ReadTime(); err == nil {
+		t.Errorf("expected an error for an unknown critical key")
+	}
+
+	// only one fraction of a second may be given
+	r = NewCBORReader(bytes.NewReader([]byte{0xd9, 0x03, 0xe9, 0xa3, 0x01, 0x00, 0x22, 0x01, 0x25, 0x01}))
+	if _, err := r.ReadTime(); err == nil {
+		t.Errorf("expected an error for both milliseconds and microseconds")
+	}
+
+	// unknown time zone hints are ignored and not cached
+	hint := "No/Such_Zone"
+	r = NewCBORReader(bytes.NewReader(append([]byte{0xd9, 0x03, 0xe9, 0xa2, 0x01, 0x00, 0x29, 0x6c}, hint...)))
+	if got, err := r.ReadTime(); err != nil || !got.Equal(time.Unix(0, 0)) {
+		t.Errorf("got %v (error %v), want the epoch", got, err)
+	}
+	if _, ok := zones.Load(hint); ok {
+		t.Errorf("expected unknown zone %s not to be cached", hint)
+	}
+
+	// day counts that do not fit into a time are rejected
+	huge := []byte{0xd8, 0x64, 0x1b, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if d, err := NewCBORReader(bytes.NewReader(huge)).ReadDate(); err == nil {
+		t.Errorf("ReadDate: expected an error for 2^62 days, got %v", d)
+	}
+	var d Date
+	if err := NewCBORReader(bytes.NewReader(huge)).Unmarshal(&d); err == nil {
+		t.Errorf("Unmarshal: expected an error for 2^62 days, got %v", d)
+	}
+	if tm, err := NewCBORReader(bytes.NewReader(huge)).ReadTime(); err == nil {
+		t.Errorf("ReadTime: expected an error for 2^62 days, got %v", tm)
+	}
+}
+
+type Resource struct {
+	Home *url.URL
+	Site url.URL
+	ID   UUID
+	IDs  []UUID
+	Blob []byte
+}
+
+func TestRoundtripSemanticTags(t *testing.T) {
+	home, _ := url.Parse("https://example.com/a?b=c#d")
+	site, _ := url.Parse("mailto:someone@example.com")
+	s := Resource{
+		Home: home,
+		Site: *site,
+		ID:   UUID{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00},
+		IDs:  []UUID{{1}, {2}},
+		Blob: []byte{0xde, 0xad},
+	}
+	if got := s.ID.String(); got != "123e4567-e89b-12d3-a456-426614174000" {
+		t.Errorf("got UUID string %s", got)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(home); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.ID); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var e Resource
+	if err := r.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if e.Home.String() != s.Home.String() || e.Site.String() != s.Site.String() ||
+		e.ID != s.ID || !reflect.DeepEqual(e.IDs, s.IDs) || !bytes.Equal(e.Blob, s.Blob) {
+		t.Errorf("got %+v, want %+v", e, s)
+	}
+	var u url.URL
+	if err := r.Unmarshal(&u); err != nil || u.String() != home.String() {
+		t.Errorf("got %v (error %v), want %v", &u, err, home)
+	}
+	var id UUID
+	if err := r.Unmarshal(&id); err != nil || id != s.ID {
+		t.Errorf("got %v (error %v), want %v", id, err, s.ID)
+	}
+
+	// untagged text and bytes are accepted alike at the top level and in
+	// fields, while ReadURI and ReadUUID require the tag
+	text := []byte{0x6b, 'h', 't', 't', 'p', 's', ':', '/', '/', 'a', '.', 'b'}
+	raw := append([]byte{0x50}, s.ID[:]...)
+	u = url.URL{}
+	if err := NewCBORReader(bytes.NewReader(text)).Unmarshal(&u); err != nil || u.String() != "https://a.b" {
+		t.Errorf("got %v (error %v), want https://a.b", &u, err)
+	}
+	id = UUID{}
+	if err := NewCBORReader(bytes.NewReader(raw)).Unmarshal(&id); err != nil || id != s.ID {
+		t.Errorf("got %v (error %v), want %v", id, err, s.ID)
+	}
+	var f Resource
+	fields := append(append([]byte{0xa2, 0x64, 'S', 'i', 't', 'e'}, text...), 0x62, 'I', 'D')
+	fields = append(fields, raw...)
+	if err := NewCBORReader(bytes.NewReader(fields)).Unmarshal(&f); err != nil || f.Site.String() != "https://a.b" || f.ID != s.ID {
+		t.Errorf("got %+v (error %v)", f, err)
+	}
+	if _, err := NewCBORReader(bytes.NewReader(text)).ReadURI(); err == nil {
+		t.Errorf("ReadURI: expected an error for an untagged string")
+	}
+	if _, err := NewCBORReader(bytes.NewReader(raw)).ReadUUID(); err == nil {
+		t.Errorf("ReadUUID: expected an error for an untagged byte string")
+	}
+	if err := NewCBORWriter(bytes.NewBuffer([]byte{})).WriteURI(&url.URL{Path: "relative/path"}); err == nil {
+		t.Errorf("WriteURI: expected an error for a relative URL")
+	}
+}
+
+func TestSemanticTagContent(t *testing.T) {
+	// {"a": 34("AQI="), "b": 33("AQI")}
+	in := []byte{0xa2, 0x61, 0x61, 0xd8, 0x22, 0x64, 'A', 'Q', 'I', '=', 0x61, 0x62, 0xd8, 0x21, 0x63, 'A', 'Q', 'I'}
+	r := NewCBORReader(bytes.NewReader(in))
+	v, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := v.(map[string]TaggedElement); m["a"].Value != "AQI=" || m["b"].Value != "AQI" {
+		t.Errorf("expected base64 strings to be kept, got %v", m)
+	}
+
+	r = NewCBORReader(bytes.NewReader(in))
+	r.SetDecodeBase64(true)
+	v, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := v.(map[string]TaggedElement)
+	if !bytes.Equal(m["a"].Value.([]byte), []byte{1, 2}) || !bytes.Equal(m["b"].Value.([]byte), []byte{1, 2}) {
+		t.Errorf("expected decoded base64, got %v", m)
+	}
+
+	var s struct {
+		A []byte `cbor:"a"`
+		B []byte `cbor:"b"`
+	}
+	r = NewCBORReader(bytes.NewReader(in))
+	if err := r.Unmarshal(&s); err != nil || !bytes.Equal(s.A, []byte{1, 2}) || !bytes.Equal(s.B, []byte{1, 2}) {
+		t.Errorf("got %v (error %v)", s, err)
+	}
+
+	invalid := [][]byte{
+		// 34("AQI") lacks padding
+		{0x81, 0xd8, 0x22, 0x63, 'A', 'Q', 'I'},
+		// 33("AQ+") is not base64url
+		{0x81, 0xd8, 0x21, 0x63, 'A', 'Q', '+'},
+		// 33(1)
+		{0x81, 0xd8, 0x21, 0x01},
+		// 32("%zz")
+		{0x81, 0xd8, 0x20, 0x63, '%', 'z', 'z'},
+		// 32("not a uri")
+		{0x81, 0xd8, 0x20, 0x69, 'n', 'o', 't', ' ', 'a', ' ', 'u', 'r', 'i'},
+		// 32("")
+		{0x81, 0xd8, 0x20, 0x60},
+		// 32("relative/path")
+		{0x81, 0xd8, 0x20, 0x6d, 'r', 'e', 'l', 'a', 't', 'i', 'v', 'e', '/', 'p', 'a', 't', 'h'},
+		// 37(h'0102')
+		{0x81, 0xd8, 0x25, 0x42, 0x01, 0x02},
+	}
+	for _, in := range invalid {
+		r := NewCBORReader(bytes.NewReader(in))
+		if _, err := r.Read(); !errors.Is(err, TagContentError) {
+			t.Errorf("reading % x: expected %v, got %v", in, TagContentError, err)
+		}
+	}
+}
+
+type Assertion struct {
+	Addr   net.IP
+	Addrs  []netip.Addr
+	Net    *net.IPNet
+	Prefix netip.Prefix
+	Iface  netip.Prefix
+}
+
+func TestRoundtripNetworkAddresses(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("2001:db8:1234::/48")
+	s := Assertion{
+		Addr:   net.ParseIP("192.0.2.1"),
+		Addrs:  []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.1.2.3")},
+		Net:    ipnet,
+		Prefix: netip.MustParsePrefix("192.0.2.0/24"),
+		Iface:  netip.MustParsePrefix("192.0.2.1/24"),
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.Prefix); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.Addr); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var e Assertion
+	if err := r.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !e.Addr.Equal(s.Addr) || !reflect.DeepEqual(e.Addrs, s.Addrs) || e.Net.String() != s.Net.String() ||
+		e.Prefix != s.Prefix || e.Iface != s.Iface {
+		t.Errorf("got %+v, want %+v", e, s)
+	}
+	var p netip.Prefix
+	if err := r.Unmarshal(&p); err != nil || p != s.Prefix {
+		t.Errorf("got %v (error %v), want %v", p, err, s.Prefix)
+	}
+	var ip net.IP
+	if err := r.Unmarshal(&ip); err != nil || !ip.Equal(s.Addr) {
+		t.Errorf("got %v (error %v), want %v", ip, err, s.Addr)
+	}
+
+	// untagged byte strings hold an address of the family their length implies
+	// {"Addr": h'c0000201', "Addrs": [h'20010db8000000000000000000000001']}
+	in := []byte{0xa2, 0x64, 'A', 'd', 'd', 'r', 0x44, 0xc0, 0x00, 0x02, 0x01,
+		0x65, 'A', 'd', 'd', 'r', 's', 0x81, 0x50, 0x20, 0x01, 0x0d, 0xb8,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	e = Assertion{}
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&e); err != nil ||
+		!e.Addr.Equal(s.Addr) || !reflect.DeepEqual(e.Addrs, s.Addrs[:1]) {
+		t.Errorf("got %+v (error %v)", e, err)
+	}
+	ip = nil
+	if err := NewCBORReader(bytes.NewReader([]byte{0x43, 0xc0, 0x00, 0x02})).Unmarshal(&ip); !errors.Is(err, TagContentError) {
+		t.Errorf("expected %v for a 3 byte address, got %v (%v)", TagContentError, err, ip)
+	}
+}
+
+func TestRoundtripUnsetAddresses(t *testing.T) {
+	type Host struct {
+		Name   string
+		Addr   netip.Addr
+		Prefix netip.Prefix
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(Host{Name: "a"}); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0xa1, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x61, 0x61}) {
+		t.Errorf("expected unset addresses to be left out, got % x", buf.Bytes())
+	}
+	addrs := []netip.Addr{{}, netip.MustParseAddr("192.0.2.1")}
+	if err := w.Marshal(addrs); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var h Host
+	if err := r.Unmarshal(&h); err != nil || h != (Host{Name: "a"}) {
+		t.Errorf("got %+v (error %v)", h, err)
+	}
+	got := []netip.Addr{netip.MustParseAddr("::1")}
+	if err := r.Unmarshal(&got); err != nil || !reflect.DeepEqual(got, addrs) {
+		t.Errorf("got %v (error %v), want %v", got, err, addrs)
+	}
+
+	p := netip.MustParsePrefix("192.0.2.0/24")
+	if err := NewCBORReader(bytes.NewReader([]byte{0xf6})).Unmarshal(&p); err != nil || p.IsValid() {
+		t.Errorf("expected null to read as the zero prefix, got %v (error %v)", p, err)
+	}
+}
+
+func TestReadNetworkAddresses(t *testing.T) {
+	// examples from RFC 9164
+	in := []byte{
+		0xd8, 0x36, 0x50, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0xde, 0xed, 0xbe, 0xef, 0xca, 0xfe, 0xfa, 0xce, 0xfe, 0xed,
+		0xd8, 0x36, 0x82, 0x18, 0x30, 0x46, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34,
+		0xd8, 0x34, 0x44, 0xc0, 0x00, 0x02, 0x01,
+		0xd8, 0x34, 0x82, 0x18, 0x18, 0x43, 0xc0, 0x00, 0x02,
+		0xd8, 0x34, 0x82, 0x44, 0xc0, 0x00, 0x02, 0x01, 0x18, 0x18,
+	}
+	r := NewCBORReader(bytes.NewReader(in))
+	if a, err := r.ReadAddr(); err != nil || a != netip.MustParseAddr("2001:db8:1234:deed:beef:cafe:face:feed") {
+		t.Errorf("got %v (error %v)", a, err)
+	}
+	if p, err := r.ReadPrefix(); err != nil || p != netip.MustParsePrefix("2001:db8:1234::/48") {
+		t.Errorf("got %v (error %v)", p, err)
+	}
+	if a, err := r.ReadAddr(); err != nil || a != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("got %v (error %v)", a, err)
+	}
+	if p, err := r.ReadPrefix(); err != nil || p != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Errorf("got %v (error %v)", p, err)
+	}
+	if p, err := r.ReadPrefix(); err != nil || p != netip.MustParsePrefix("192.0.2.1/24") {
+		t.Errorf("got %v (error %v)", p, err)
+	}
+
+	invalid := [][]byte{
+		// 52(h'c00002') is too short for an address
+		{0x81, 0xd8, 0x34, 0x43, 0xc0, 0x00, 0x02},
+		// 52([24, h'c0000200']) has a trailing zero byte
+		{0x81, 0xd8, 0x34, 0x82, 0x18, 0x18, 0x44, 0xc0, 0x00, 0x02, 0x00},
+		// 52([8, h'c000']) has bits set beyond the prefix length
+		{0x81, 0xd8, 0x34, 0x82, 0x08, 0x42, 0xc0, 0x01},
+		// 52([33, h'c0']) is too long
+		{0x81, 0xd8, 0x34, 0x82, 0x18, 0x21, 0x41, 0xc0},
+	}
+	for _, in := range invalid {
+		r := NewCBORReader(bytes.NewReader(in))
+		if _, err := r.Read(); !errors.Is(err, TagContentError) {
+			t.Errorf("reading % x: expected %v, got %v", in, TagContentError, err)
+		}
+	}
+}
+
+func TestRoundtripSimpleValues(t *testing.T) {
+	type Simples struct {
+		V    SimpleValue
+		List []SimpleValue
+		Map  map[string]SimpleValue
+	}
+	for _, v := range []SimpleValue{0, 16, 20, 21, 22, Undefined, 32, 255} {
+		s := Simples{V: v, List: []SimpleValue{v, 21}, Map: map[string]SimpleValue{"v": v}}
+		buf := bytes.NewBuffer([]byte{})
+		if err := NewCBORWriter(buf).Marshal(s); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var e Simples
+		if err := NewCBORReader(buf).Unmarshal(&e); err != nil {
+			t.Fatalf("Unmarshal of simple value %d failed: %v", v, err)
+		}
+		if diff, ok := messagediff.PrettyDiff(e, s); !ok {
+			t.Errorf("simple value %d: structs differ, diff: %v", v, diff)
+		}
+	}
+}
+
+type Envelope struct {
+	Kind string
+	Body RawMessage
+}
+
+type SignedEnvelope struct {
+	Env Envelope `cbor:"#1"`
+	Sig []byte   `cbor:"#2"`
+}
+
+func TestRoundtripRawMessage(t *testing.T) {
+	// the body is an indefinite-length array holding a non-minimal integer
+	// and a half float, which would not survive decoding and re-encoding
+	body := []byte{0x9f, 0x18, 0x01, 0xf9, 0x3c, 0x00, 0xff}
+	in := []byte{0xa2, 0x01, 0xa3,
+		0x64, 0x4b, 0x69, 0x6e, 0x64, 0x61, 0x61,
+		0x65, 0x45, 0x78, 0x74, 0x72, 0x61, 0x01,
+		0x64, 0x42, 0x6f, 0x64, 0x79}
+	in = append(in, body...)
+	in = append(in, 0x02, 0x42, 0x01, 0x02)
+
+	var s SignedEnvelope
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if s.Env.Kind != "a" || !bytes.Equal(s.Env.Body, body) || !bytes.Equal(s.Sig, []byte{1, 2}) {
+		t.Fatalf("got %+v", s)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s.Env.Body); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), body) {
+		t.Errorf("raw message not written verbatim: % x", buf.Bytes())
+	}
+
+	r := NewCBORReader(buf)
+	var raw RawMessage
+	if err := r.Unmarshal(&raw); err != nil || !bytes.Equal(raw, body) {
+		t.Errorf("got % x (error %v), want % x", raw, err, body)
+	}
+	var e SignedEnvelope
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+
+	if err := w.Marshal(RawMessage{0x82, 0x01}); err == nil {
+		t.Errorf("expected error writing truncated raw message")
+	}
+}
+
+func TestRoundtripEmbedded(t *testing.T) {
+	env := Envelope{Kind: "b", Body: RawMessage{0x01}}
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.WriteEmbedded(env); err != nil {
+		t.Fatalf("WriteEmbedded failed: %v", err)
+	}
+	if err := w.WriteEmbedded([]int{1, 2}); err != nil {
+		t.Fatalf("WriteEmbedded failed: %v", err)
+	}
+	if err := w.WriteEmbedded(env); err != nil {
+		t.Fatalf("WriteEmbedded failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0xd8, 0x18, 0x4e, 0xa2}) {
+		t.Errorf("unexpected encoding % x", buf.Bytes())
+	}
+
+	r := NewCBORReader(buf)
+	var e Envelope
+	if err := r.ReadEmbedded(&e); err != nil || !reflect.DeepEqual(e, env) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, env)
+	}
+	var raw RawMessage
+	if err := r.ReadEmbedded(&raw); err != nil || !bytes.Equal(raw, []byte{0x82, 0x01, 0x02}) {
+		t.Errorf("got % x (error %v)", raw, err)
+	}
+	var m map[string]interface{}
+	if err := r.ReadEmbedded(&m); err != nil || m["Kind"] != "b" {
+		t.Errorf("got %v (error %v)", m, err)
+	}
+
+	// embedded items must be a byte string holding exactly one item
+	for _, in := range [][]byte{
+		{0x81, 0xd8, 0x18, 0x42, 0x01, 0x02},
+		{0x81, 0xd8, 0x18, 0x41, 0x82},
+		{0x81, 0xd8, 0x18, 0x01},
+	} {
+		if _, err := NewCBORReader(bytes.NewReader(in)).ReadArray(); !errors.Is(err, TagContentError) {
+			t.Errorf("% x: expected tag content error, got %v", in, err)
+		}
+	}
+	r = NewCBORReader(bytes.NewReader([]byte{0xd8, 0x18, 0x42, 0x01, 0x02}))
+	var i int
+	if err := r.ReadEmbedded(&i); !errors.Is(err, TagContentError) {
+		t.Errorf("expected tag content error for trailing data, got %v", err)
+	}
+}
+
+type Optional struct {
+	Name  *string
+	Count *int
+	Inner *Envelope
+	List  []int
+	Any   interface{}
+}
+
+func TestRoundtripNil(t *testing.T) {
+	name, count := "x", 3
+	s := Optional{Name: &name, Count: &count, Inner: &Envelope{Kind: "c", Body: RawMessage{0x01}}, List: []int{1}, Any: "y"}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(Optional{}); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.WriteStringMap(map[string]interface{}{"Name": nil, "Count": nil, "Inner": nil, "List": nil, "Any": nil}); err != nil {
+		t.Fatalf("WriteStringMap failed: %v", err)
+	}
+	if err := w.Marshal((*int)(nil)); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(&count); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var e Optional
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+	// nil pointers are left out and leave fields as they are, while nil
+	// slices are written as null and set fields to nil
+	s.List = nil
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, Optional{}) {
+		t.Errorf("got %+v (error %v), want all nil", e, err)
+	}
+	p := &count
+	if err := r.Unmarshal(&p); err != nil || p != nil {
+		t.Errorf("got %v (error %v), want nil", p, err)
+	}
+	if err := r.Unmarshal(&p); err != nil || p == nil || *p != count {
+		t.Errorf("got %v (error %v), want %d", p, err, count)
+	}
+}
+
+type Leaf struct {
+	N int
+}
+
+type Pointers struct {
+	Str    *string
+	Int    **int
+	Leaf   **Leaf
+	List   *[]int
+	Ptrs   []*string
+	Leaves []*Leaf
+	Counts map[string]*int
+	When   *time.Time
+	Big    **big.Int
+	Flag   **bool
+	Absent *string
+}
+
+func TestRoundtripPointers(t *testing.T) {
+	str, i, yes := "s", 7, true
+	pi, pyes := &i, &yes
+	leaf := &Leaf{N: 1}
+	list := []int{1, 2}
+	when := time.Unix(1500000000, 0).UTC()
+	b := big.NewInt(-5)
+	s := Pointers{
+		Str:    &str,
+		Int:    &pi,
+		Leaf:   &leaf,
+		List:   &list,
+		Ptrs:   []*string{&str, nil},
+		Leaves: []*Leaf{leaf, {N: 2}},
+		Counts: map[string]*int{"a": &i},
+		When:   &when,
+		Big:    &b,
+		Flag:   &pyes,
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal([]*int{&i, nil}); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, v := range []interface{}{true, &yes, &pyes} {
+		if err := w.Marshal(v); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+	}
+
+	r := NewCBORReader(buf)
+	var e Pointers
+	if err := r.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if e.When == nil || !e.When.Equal(when) {
+		t.Errorf("got time %v, want %v", e.When, when)
+	}
+	e.When, s.When = nil, nil
+	if diff, equal := messagediff.PrettyDiff(e, s); !equal {
+		t.Errorf("unexpected result: %+v diff=%s", e, diff)
+	}
+	var ptrs []*int
+	if err := r.Unmarshal(&ptrs); err != nil || len(ptrs) != 2 || *ptrs[0] != i || ptrs[1] != nil {
+		t.Errorf("got %v (error %v)", ptrs, err)
+	}
+	var flag bool
+	if err := r.Unmarshal(&flag); err != nil || !flag {
+		t.Errorf("got %v (error %v), want true", flag, err)
+	}
+	var pflag *bool
+	if err := r.Unmarshal(&pflag); err != nil || pflag == nil || !*pflag {
+		t.Errorf("got %v (error %v), want a pointer to true", pflag, err)
+	}
+	var ppflag **bool
+	if err := r.Unmarshal(&ppflag); err != nil || ppflag == nil || *ppflag == nil || !**ppflag {
+		t.Errorf("got %v (error %v), want a pointer to a pointer to true", ppflag, err)
+	}
+	if err := NewCBORReader(bytes.NewReader([]byte{0x01})).Unmarshal(&flag); err != CBORTypeReadError {
+		t.Errorf("expected a type error reading 1 into a bool, got %v", err)
+	}
+}
+
+type Arrays struct {
+	Ints    [3]int
+	Strs    [2]string
+	Leaves  [2]Leaf
+	Ptrs    [2]*Leaf
+	Nested  [2][2]int8
+	Digest  [32]byte
+	Small   [4]uint16
+	Floats  [2]float32
+	Untyped [2]interface{}
+}
+
+func TestRoundtripArrays(t *testing.T) {
+	s := Arrays{
+		Ints:    [3]int{1, -2, 3},
+		Strs:    [2]string{"a", "b"},
+		Leaves:  [2]Leaf{{N: 1}, {N: 2}},
+		Ptrs:    [2]*Leaf{{N: 3}, nil},
+		Nested:  [2][2]int8{{1, 2}, {-3, 4}},
+		Small:   [4]uint16{1, 300, 65535, 0},
+		Floats:  [2]float32{1.5, -2},
+		Untyped: [2]interface{}{"x", 1},
+	}
+	for i := range s.Digest {
+		s.Digest[i] = byte(i)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.Ints); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.WriteBytes(s.Digest[:]); err != nil {
+		t.Fatalf("WriteBytes failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var e Arrays
+	if err := r.Unmarshal(&e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff, equal := messagediff.PrettyDiff(e, s); !equal {
+		t.Errorf("unexpected result: %+v diff=%s", e, diff)
+	}
+	var ints [3]int
+	if err := r.Unmarshal(&ints); err != nil || ints != s.Ints {
+		t.Errorf("got %v (error %v), want %v", ints, err, s.Ints)
+	}
+	var digest [32]byte
+	if err := r.Unmarshal(&digest); err != nil || digest != s.Digest {
+		t.Errorf("got %x (error %v), want %x", digest, err, s.Digest)
+	}
+}
+
+func TestReadArrayLengthMismatch(t *testing.T) {
+	for _, in := range [][]byte{
+		{0x82, 0x01, 0x02},
+		{0x84, 0x01, 0x02, 0x03, 0x04},
+		{0x42, 0x01, 0x02},
+		{0x63, 0x61, 0x62, 0x63},
+	} {
+		var a [3]uint8
+		if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&a); err == nil {
+			t.Errorf("% x: expected error, got %v", in, a)
+		}
+	}
+	var s struct{ A [2]int }
+	in := []byte{0xa1, 0x61, 0x41, 0x83, 0x01, 0x02, 0x03}
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&s); err == nil {
+		t.Errorf("expected error for array length mismatch, got %v", s)
+	}
+	var b [1]uint8
+	if err := NewCBORReader(bytes.NewReader([]byte{0x81, 0x19, 0x01, 0x00})).Unmarshal(&b); !errors.Is(err, IntegerOverflowError) {
+		t.Errorf("expected integer overflow, got %v", err)
+	}
+}
+
+type Digest [8]byte
+
+type Blob []byte
+
+type ByteArrays struct {
+	Digest Digest   `cbor:"#1"`
+	Blob   Blob     `cbor:"#2"`
+	Legacy [4]byte  `cbor:"#3,array"`
+	Ptr    *[2]byte `cbor:"#4"`
+}
+
+func TestRoundtripByteArrays(t *testing.T) {
+	s := ByteArrays{
+		Digest: Digest{1, 2, 3, 4, 5, 6, 7, 8},
+		Blob:   Blob{9, 10},
+		Legacy: [4]byte{0xc, 0xa, 0xf, 0xe},
+		Ptr:    &[2]byte{11, 12},
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte{0x03, 0x84, 0x0c, 0x0a, 0x0f, 0x0e}) ||
+		!bytes.Contains(buf.Bytes(), []byte{0x01, 0x48, 0x01}) {
+		t.Errorf("unexpected encoding % x", buf.Bytes())
+	}
+	if err := w.Marshal(s.Digest); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var e ByteArrays
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+	var d Digest
+	if err := r.Unmarshal(&d); err != nil || d != s.Digest {
+		t.Errorf("got %v (error %v), want %v", d, err, s.Digest)
+	}
+}
+
+type Digests struct {
+	H     [][32]byte
+	Pairs [][2]int
+	Grid  [][2][2]string
+}
+
+func TestRoundtripSliceOfArrays(t *testing.T) {
+	s := Digests{
+		H:     [][32]byte{{1, 2, 3}, {31: 0xff}},
+		Pairs: [][2]int{{1, -1}, {2, 300}},
+		Grid:  [][2][2]string{{{"a", "b"}, {"c", "d"}}},
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.H); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.Pairs); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	r := NewCBORReader(buf)
+	var e Digests
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+	var h [][32]byte
+	if err := r.Unmarshal(&h); err != nil || !reflect.DeepEqual(h, s.H) {
+		t.Errorf("got %x (error %v), want %x", h, err, s.H)
+	}
+	var pairs [][2]int
+	if err := r.Unmarshal(&pairs); err != nil || !reflect.DeepEqual(pairs, s.Pairs) {
+		t.Errorf("got %v (error %v), want %v", pairs, err, s.Pairs)
+	}
+}
+
+type Batch struct {
+	Items   []RawMessage
+	ByName  map[string]RawMessage
+	Envs    []Envelope
+	Chunks  [][]byte
+	Nothing []RawMessage
+}
+
+func TestRawMessageContainers(t *testing.T) {
+	// [1, "x", [_ 2]]
+	in := []byte{0x83, 0x01, 0x61, 0x78, 0x9f, 0x02, 0xff}
+	var items []RawMessage
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&items); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	expected := []RawMessage{{0x01}, {0x61, 0x78}, {0x9f, 0x02, 0xff}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("got % x, want % x", items, expected)
+	}
+
+	// {"a": 1.0 as a half float, 2: h'01'}
+	in = []byte{0xa2, 0x61, 0x61, 0xf9, 0x3c, 0x00, 0x02, 0x41, 0x01}
+	var m map[string]RawMessage
+	if err := NewCBORReader(bytes.NewReader(in)).Unmarshal(&m); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(m, map[string]RawMessage{"a": {0xf9, 0x3c, 0x00}, "2": {0x41, 0x01}}) {
+		t.Errorf("got % x", m)
+	}
+
+	s := Batch{
+		Items:  expected,
+		ByName: map[string]RawMessage{"k": {0xf5}},
+		Envs:   []Envelope{{Kind: "e", Body: RawMessage{0x80}}},
+		Chunks: [][]byte{{1, 2}, {}},
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := NewCBORWriter(buf)
+	if err := w.Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := w.Marshal(s.Chunks); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	r := NewCBORReader(buf)
+	var e Batch
+	if err := r.Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+	var chunks [][]byte
+	if err := r.Unmarshal(&chunks); err != nil || !reflect.DeepEqual(chunks, s.Chunks) {
+		t.Errorf("got %v (error %v), want %v", chunks, err, s.Chunks)
+	}
+
+	// elements of the wrong type are errors rather than panics
+	var nested [][]RawMessage
+	if err := NewCBORReader(bytes.NewReader([]byte{0x82, 0x01, 0x61, 0x78})).Unmarshal(&nested); err == nil {
+		t.Errorf("expected error, got %v", nested)
+	}
+	var lists [][]int
+	if err := NewCBORReader(bytes.NewReader([]byte{0x82, 0x01, 0x61, 0x78})).Unmarshal(&lists); err == nil {
+		t.Errorf("expected error, got %v", lists)
+	}
+}
+
+type MyByte uint8
+
+func TestNamedByteElements(t *testing.T) {
+	// named element types are not bytes, so they are written as arrays
+	s := struct {
+		A [2]MyByte
+		S []MyByte
+	}{A: [2]MyByte{1, 2}, S: []MyByte{3}}
+	buf := bytes.NewBuffer([]byte{})
+	if err := NewCBORWriter(buf).Marshal(s); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	e := s
+	e.A, e.S = [2]MyByte{}, nil
+	if err := NewCBORReader(buf).Unmarshal(&e); err != nil || !reflect.DeepEqual(e, s) {
+		t.Errorf("got %+v (error %v), want %+v", e, err, s)
+	}
+
+	var a [2]MyByte
+	if err := NewCBORReader(bytes.NewReader([]byte{0x42, 0x01, 0x02})).Unmarshal(&a); err == nil {
+		t.Errorf("expected error reading byte string into %T, got %v", a, a)
+	}
+	var f struct{ S []MyByte }
+	if err := NewCBORReader(bytes.NewReader([]byte{0xa1, 0x61, 0x53, 0x42, 0x01, 0x02})).Unmarshal(&f); err == nil {
+		t.Errorf("expected error reading byte string into %T, got %v", f.S, f.S)
+	}
+}
@@ -0,0 +1,129 @@
+package borat
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// TagContentError is returned when the content of a tag does not have the
+// type or form the tag requires, such as a URI which does not parse.
+var TagContentError = errors.New("invalid content for tag")
+
+// UUID is a universally unique identifier as defined in RFC 4122. It is
+// encoded as a 16 byte string with tag 37.
+type UUID [16]byte
+
+// String returns the UUID in its canonical form, e.g.
+// 123e4567-e89b-12d3-a456-426614174000.
+func (u UUID) String() string {
+	b := make([]byte, 36)
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b)
+}
+
+// base64Encodings are the encodings expected in the content of tags 33 and
+// 34: base64url without padding, and classic base64 with padding.
+var base64Encodings = map[CBORTag]*base64.Encoding{
+	TagBase64URL: base64.RawURLEncoding.Strict(),
+	TagBase64:    base64.StdEncoding.Strict(),
+}
+
+// checkTagContent verifies that v, as returned by Read, is valid content for
+// tag. Tags without defined semantics are not checked. If decodeBase64 is set,
+// base64 strings are returned decoded.
+func checkTagContent(tag CBORTag, v interface{}, decodeBase64 bool) (interface{}, error) {
+	switch tag {
+	case TagURI:
+		if _, err := urlFromElement(TaggedElement{Tag: tag, Value: v}); err != nil {
+			return nil, err
+		}
+	case TagBase64URL, TagBase64:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w %d: %T is not a text string", TagContentError, tag, v)
+		}
+		b, err := base64Encodings[tag].DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: %v", TagContentError, tag, err)
+		}
+		if decodeBase64 {
+			return b, nil
+		}
+	case TagEmbedded:
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("%w %d: %T is not a byte string", TagContentError, tag, v)
+		}
+		if err := checkWellFormed(b); err != nil {
+			return nil, fmt.Errorf("%w %d: %v", TagContentError, tag, err)
+		}
+	case TagUUID:
+		if _, err := uuidFromElement(TaggedElement{Tag: tag, Value: v}); err != nil {
+			return nil, err
+		}
+	case TagIPv4, TagIPv6:
+		if err := checkAddrContent(tag, v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// urlFromElement converts a value returned by Read into a URL. Tag 32 holds
+// an absolute URI rather than a relative reference. Untagged strings are
+// accepted as well, and may be relative.
+func urlFromElement(elem TaggedElement) (*url.URL, error) {
+	s, ok := elem.Value.(string)
+	if !ok || (elem.Tag != TagURI && elem.Tag != CBORTag(0)) {
+		return nil, fmt.Errorf("%w %d: cannot convert %T to a URI", TagContentError, elem.Tag, elem.Value)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w %d: %v", TagContentError, elem.Tag, err)
+	}
+	if elem.Tag == TagURI && !u.IsAbs() {
+		return nil, fmt.Errorf("%w %d: %q is not an absolute URI", TagContentError, elem.Tag, s)
+	}
+	return u, nil
+}
+
+// uuidFromElement converts a value returned by Read into a UUID. Untagged
+// byte strings are accepted as well.
+func uuidFromElement(elem TaggedElement) (UUID, error) {
+	var u UUID
+	b, ok := elem.Value.([]byte)
+	if !ok || (elem.Tag != TagUUID && elem.Tag != CBORTag(0)) {
+		return u, fmt.Errorf("%w %d: cannot convert %T to a UUID", TagContentError, elem.Tag, elem.Value)
+	}
+	if len(b) != len(u) {
+		return u, fmt.Errorf("%w %d: UUID has %d bytes", TagContentError, elem.Tag, len(b))
+	}
+	copy(u[:], b)
+	return u, nil
+}
+
+// bytesFromElement returns the bytes held by a value returned by Read, which
+// is either a byte string or a base64 string with tag 33 or 34.
+func bytesFromElement(elem TaggedElement) ([]byte, bool) {
+	switch v := elem.Value.(type) {
+	case []byte:
+		return v, true
+	case string:
+		if enc, ok := base64Encodings[elem.Tag]; ok {
+			b, err := enc.DecodeString(v)
+			return b, err == nil
+		}
+	}
+	return nil, false
+}
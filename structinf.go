@@ -2,9 +2,15 @@ package borat
 
 import (
 	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // structCBORSpec represents metadata for writing structures.
@@ -13,6 +19,197 @@ type structCBORSpec struct {
 	hasTag         bool
 	intKeyForField map[string]int
 	strKeyForField map[string]string
+	// Fields of byte arrays or slices to be written as arrays of integers
+	// rather than as byte strings.
+	arrayFields map[string]bool
+}
+
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+	decimalType  = reflect.TypeOf(Decimal{})
+	timeType     = reflect.TypeOf(time.Time{})
+	dateType     = reflect.TypeOf(Date{})
+	urlType      = reflect.TypeOf(url.URL{})
+	uuidType     = reflect.TypeOf(UUID{})
+	ipType       = reflect.TypeOf(net.IP{})
+	ipNetType    = reflect.TypeOf(net.IPNet{})
+	addrType     = reflect.TypeOf(netip.Addr{})
+	prefixType   = reflect.TypeOf(netip.Prefix{})
+	rawType      = reflect.TypeOf(RawMessage{})
+	byteType     = reflect.TypeOf(byte(0))
+	simpleType   = reflect.TypeOf(SimpleValue(0))
+)
+
+// elementConverters convert values returned by Read into the types which have
+// their own CBOR representation, returning a pointer to the result.
+var elementConverters = map[reflect.Type]func(TaggedElement) (interface{}, error){
+	bigIntType: func(elem TaggedElement) (interface{}, error) {
+		return bigIntFromElement(elem)
+	},
+	bigFloatType: func(elem TaggedElement) (interface{}, error) {
+		m, exp, err := mantExpFromElement(elem, TagBigFloat)
+		if err != nil {
+			return nil, err
+		}
+		return newBigFloat(m, exp), nil
+	},
+	decimalType: func(elem TaggedElement) (interface{}, error) {
+		m, exp, err := mantExpFromElement(elem, TagDecimal)
+		if err != nil {
+			return nil, err
+		}
+		return &Decimal{Mantissa: m, Exponent: exp}, nil
+	},
+	timeType: func(elem TaggedElement) (interface{}, error) {
+		t, err := timeFromElement(elem)
+		return &t, err
+	},
+	dateType: func(elem TaggedElement) (interface{}, error) {
+		d, err := dateFromElement(elem)
+		return &d, err
+	},
+	urlType: func(elem TaggedElement) (interface{}, error) {
+		return urlFromElement(elem)
+	},
+	uuidType: func(elem TaggedElement) (interface{}, error) {
+		u, err := uuidFromElement(elem)
+		return &u, err
+	},
+	ipType: func(elem TaggedElement) (interface{}, error) {
+		ip, err := ipFromElement(elem)
+		return &ip, err
+	},
+	ipNetType: func(elem TaggedElement) (interface{}, error) {
+		return ipNetFromElement(elem)
+	},
+	addrType: func(elem TaggedElement) (interface{}, error) {
+		a, err := addrFromElement(elem)
+		return &a, err
+	},
+	prefixType: func(elem TaggedElement) (interface{}, error) {
+		p, err := prefixFromElement(elem)
+		return &p, err
+	},
+}
+
+// isConvertedType reports whether t, or the type t points to, is converted by
+// setConverted.
+func isConvertedType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	_, ok := elementConverters[t]
+	return ok
+}
+
+// rawTypes caches the result of containsRaw for each type.
+var rawTypes sync.Map
+
+// containsRaw reports whether values of type t hold a RawMessage, directly or
+// in their elements or struct fields. Such values have to be read straight
+// from the input rather than from the result of Read.
+func containsRaw(t reflect.Type) bool {
+	if c, ok := rawTypes.Load(t); ok {
+		return c.(bool)
+	}
+	c := findRaw(t, make(map[reflect.Type]bool))
+	rawTypes.Store(t, c)
+	return c
+}
+
+func findRaw(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == rawType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return findRaw(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] || isConvertedType(t) {
+			return false
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && findRaw(f.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setConverted stores elem in out, which must be of a type accepted by
+// isConvertedType.
+func setConverted(out reflect.Value, elem TaggedElement) error {
+	t := out.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	convert, ok := elementConverters[t]
+	if !ok {
+		return fmt.Errorf("no conversion to %v", out.Type())
+	}
+	p, err := convert(elem)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(p)
+	if out.Kind() == reflect.Ptr {
+		out.Set(v)
+	} else {
+		out.Set(v.Elem())
+	}
+	return nil
+}
+
+// isIntegerKind reports whether k is one of the sized int or uint kinds.
+func isIntegerKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// isNilKind reports whether values of kind k can be nil, and so are written
+// as null when they are.
+func isNilKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return true
+	}
+	return false
+}
+
+// isOmittedField reports whether a struct field is left out when the struct
+// is written: nil pointers and interfaces and unset values are, while other
+// nil values are written as null.
+func isOmittedField(v reflect.Value) bool {
+	return (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() || isUnsetValue(v)
+}
+
+// isUnsetValue reports whether v is the zero netip.Addr, netip.Prefix or
+// Date, which is written as null as it has no valid encoding.
+func isUnsetValue(v reflect.Value) bool {
+	return (v.Type() == addrType || v.Type() == prefixType || v.Type() == dateType) && v.IsZero()
+}
+
+// isNullable reports whether null is read into a value of type t as its zero
+// value: nil kinds, and the types whose zero value is written as null.
+func isNullable(t reflect.Type) bool {
+	return isNilKind(t.Kind()) || t == addrType || t == prefixType || t == dateType
+}
+
+// isIntegerValue reports whether v is an integer as returned by Read.
+func isIntegerValue(v interface{}) bool {
+	switch v.(type) {
+	case int, uint64, *big.Int:
+		return true
+	}
+	return false
 }
 
 // TaggedElement is used to wrap elements which may be tagged for writing.
@@ -25,14 +222,29 @@ func (scs *structCBORSpec) usingIntKeys() bool {
 	return scs.intKeyForField != nil
 }
 
+// acceptsTag reports whether a struct of type t may be tagged with tag, either
+// because of its cborTag member or because the tag is registered for t.
+func (scs *structCBORSpec) acceptsTag(tag CBORTag, t reflect.Type, registry map[CBORTag]reflect.Type) bool {
+	if scs.hasTag && CBORTag(scs.tag) == tag {
+		return true
+	}
+	rt, ok := registry[tag]
+	return ok && (rt == t || rt == reflect.PtrTo(t))
+}
+
 func (scs *structCBORSpec) learnStruct(t reflect.Type) error {
 	for i, n := 0, t.NumField(); i < n; i++ {
 		f := t.Field(i)
 
 		// only process fields that are exportable
 		if f.PkgPath == "" {
-			// check for a struct tag
-			tag := f.Tag.Get("cbor")
+			// check for a struct tag, which may be followed by options
+			tag, opts, _ := strings.Cut(f.Tag.Get("cbor"), ",")
+			if opts != "" {
+				if err := scs.learnOptions(t, f, opts); err != nil {
+					return err
+				}
+			}
 			if tag != "" {
 				// generate map key from tag
 				if strings.HasPrefix(tag, "#") {
@@ -84,6 +296,45 @@ func (scs *structCBORSpec) learnStruct(t reflect.Type) error {
 	return nil
 }
 
+// learnOptions records the options given after the key in the struct tag of
+// field f of t.
+func (scs *structCBORSpec) learnOptions(t reflect.Type, f reflect.StructField, opts string) error {
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "array":
+			if !isByteSequence(f.Type) {
+				return fmt.Errorf("array option on %s.%s, which is not a byte array or slice", t.Name(), f.Name)
+			}
+			if scs.arrayFields == nil {
+				scs.arrayFields = make(map[string]bool)
+			}
+			scs.arrayFields[f.Name] = true
+		default:
+			return fmt.Errorf("unknown option %q in tag of %s.%s", opt, t.Name(), f.Name)
+		}
+	}
+	return nil
+}
+
+// isByteSequence reports whether t is a byte array or slice, including named
+// types based on them, which are written as byte strings.
+func isByteSequence(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem() == byteType
+}
+
+// fieldValue returns the value to be written for field i of v.
+func (scs *structCBORSpec) fieldValue(v reflect.Value, i int) interface{} {
+	f := v.Field(i)
+	if !scs.arrayFields[v.Type().Field(i).Name] || (f.Kind() == reflect.Slice && f.IsNil()) {
+		return f.Interface()
+	}
+	a := make([]interface{}, f.Len())
+	for j := range a {
+		a[j] = f.Index(j).Interface()
+	}
+	return a
+}
+
 func (scs *structCBORSpec) convertStructToIntMap(v reflect.Value) (map[int]interface{}, error) {
 	if scs.intKeyForField == nil {
 		return nil, fmt.Errorf("can't convert %s to integer-keyed map", v.Type().Name())
@@ -93,34 +344,63 @@ func (scs *structCBORSpec) convertStructToIntMap(v reflect.Value) (map[int]inter
 
 	for i, n := 0, v.NumField(); i < n; i++ {
 		fieldName := v.Type().Field(i).Name
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
 		fieldVal := v.Field(i)
-		out[scs.intKeyForField[fieldName]] = fieldVal.Interface()
+		// Leave out nil fields in the same way as convertStructToStringMap.
+		if isOmittedField(fieldVal) {
+			continue
+		}
+		out[scs.intKeyForField[fieldName]] = scs.fieldValue(v, i)
 	}
 
 	return out, nil
 }
 
-func (scs *structCBORSpec) convertIntMapToStruct(in map[int]interface{}, out reflect.Value) error {
+func (scs *structCBORSpec) convertIntMapToStruct(in map[int]TaggedElement, out reflect.Value, registry map[CBORTag]reflect.Type) error {
 	if scs.intKeyForField == nil {
 		return fmt.Errorf("can't parse int map for struct type %s", out.Type().Name())
 	}
+	if out.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot convertIntMapToStruct on non-struct: %v", out.Kind())
+	}
 
 	for i, n := 0, out.NumField(); i < n; i++ {
 		fieldName := out.Type().Field(i).Name
-		mapIdx := scs.intKeyForField[fieldName]
-		// If this is a struct we should do something special here.
-		if value, ok := in[mapIdx]; ok {
-			// If this field is of type int but we have a uint64, we can cast
-			// it, provided that it fits.
-			if out.Field(i).Kind() == reflect.Int && reflect.ValueOf(value).Kind() == reflect.Uint64 {
-				value = int(value.(uint64))
+		mapIdx, ok := scs.intKeyForField[fieldName]
+		if !ok {
+			continue
+		}
+		if elem, ok := in[mapIdx]; ok {
+			if err := scs.handleElement(out.Field(i), elem, registry); err != nil {
+				return fmt.Errorf("field %s of %s: %w", fieldName, out.Type().Name(), err)
 			}
-			out.Field(i).Set(reflect.ValueOf(value))
 		}
 	}
 	return nil
 }
 
+// convertMapToStruct sets the struct referenced by out to the data in in,
+// which should be a map as returned by CBORReader.Read. Depending on the
+// struct, the map is expected to be keyed by integers or by strings.
+func (scs *structCBORSpec) convertMapToStruct(in interface{}, out reflect.Value, registry map[CBORTag]reflect.Type) error {
+	switch m := in.(type) {
+	case map[int]TaggedElement:
+		// Read cannot tell which kind of empty map it has seen.
+		if len(m) == 0 && !scs.usingIntKeys() {
+			return scs.convertStringMapToStruct(map[string]TaggedElement{}, out, registry)
+		}
+		return scs.convertIntMapToStruct(m, out, registry)
+	case map[string]TaggedElement:
+		if len(m) == 0 && scs.usingIntKeys() {
+			return scs.convertIntMapToStruct(map[int]TaggedElement{}, out, registry)
+		}
+		return scs.convertStringMapToStruct(m, out, registry)
+	}
+	return fmt.Errorf("cannot convert %T to struct type %v", in, out.Type())
+}
+
 func (scs *structCBORSpec) convertStructToStringMap(v reflect.Value) (map[string]TaggedElement, error) {
 	if scs.strKeyForField == nil {
 		return nil, fmt.Errorf("can't convert %s to string-keyed map", v.Type().Name())
@@ -134,15 +414,14 @@ func (scs *structCBORSpec) convertStructToStringMap(v reflect.Value) (map[string
 			continue
 		}
 		fieldVal := v.Field(i)
-		// If it is a zero field, then do not include it in the map.
-		// We do it this way to also catch if it is a nil pointer,
-		// since the pointer kind is not invalid but it's inner value is.
-		if reflect.ValueOf(fieldVal.Interface()).Kind() == reflect.Invalid {
+		// If it is a nil pointer or interface, then do not include it in
+		// the map.
+		if isOmittedField(fieldVal) {
 			continue
 		}
 		// Do not tag structs over here because Marshal does that.
 		elem := TaggedElement{
-			Value: fieldVal.Interface(),
+			Value: scs.fieldValue(v, i),
 		}
 		out[scs.strKeyForField[fieldName]] = elem
 	}
@@ -156,249 +435,343 @@ func (scs *structCBORSpec) handleSlice(out reflect.Value, in []TaggedElement, re
 	if out.Kind() != reflect.Slice {
 		return fmt.Errorf("called handleSlice on non-slice type %v: %v", out.Type().Name(), in)
 	}
-	k := out.Type().Elem().Kind()
-	t := out.Type().Elem()
-	if k == reflect.Ptr {
-		k = out.Type().Elem().Elem().Kind()
-		t = out.Type().Elem().Elem()
-	}
-	switch k {
-	case reflect.Uint64, reflect.String:
-		for i, e := range in {
-			val := reflect.ValueOf(e.Value)
-			if e.Tag != CBORTag(0) {
-				t, ok := registry[e.Tag]
-				if !ok {
-					return fmt.Errorf("unknown tag %d", e.Tag)
-				}
-				if !val.Type().ConvertibleTo(t) {
-					return fmt.Errorf("%v not convertible to tag type %v", val.Type(), t)
-				}
-				out.Index(i).Set(val.Convert(t))
-			} else {
-				out.Index(i).Set(reflect.ValueOf(e.Value))
-			}
-		}
-	case reflect.Int:
-		it := reflect.TypeOf(int(0))
-		for i, e := range in {
-			val := reflect.ValueOf(e.Value)
-			if e.Tag != CBORTag(0) {
-				t, ok := registry[e.Tag]
-				if !ok {
-					return fmt.Errorf("unknown tag %d", e.Tag)
-				}
-				if !val.Type().ConvertibleTo(t) {
-					return fmt.Errorf("%v not convertible to tag type %v", val.Type(), t)
-				}
-				it = t
-			}
-			out.Index(i).Set(val.Convert(it))
-		}
-	case reflect.Uint8:
-		u8t := reflect.TypeOf(uint8(0))
-		for i, e := range in {
-			val := reflect.ValueOf(e.Value)
-			if e.Tag != CBORTag(0) {
-				t, ok := registry[e.Tag]
-				if !ok {
-					return fmt.Errorf("unknown tag %d", e.Tag)
-				}
-				if !val.Type().ConvertibleTo(t) {
-					return fmt.Errorf("%v not convertible to tag type %v", val.Type(), t)
-				}
-				u8t = t
-			}
-			out.Index(i).Set(val.Convert(u8t))
-		}
-	case reflect.Struct:
-		childScs := &structCBORSpec{}
-		childScs.learnStruct(t)
-		for i, e := range in {
-			childScs.convertStringMapToStruct(e.Value.(map[string]TaggedElement), out.Index(i), registry)
-		}
-	case reflect.Slice:
-		for i, inElem := range in {
-			slen := len(inElem.Value.([]TaggedElement))
-			slice := reflect.MakeSlice(out.Type().Elem(), slen, slen)
-			out.Index(i).Set(slice)
-			scs.handleSlice(out.Index(i), inElem.Value.([]TaggedElement), registry)
-		}
-	case reflect.Interface:
-		for i, inElem := range in {
-			te, ok := inElem.Value.(map[string]TaggedElement)
-			if !ok {
-				return fmt.Errorf("idx %d: expected in parameter to be array of maps but got: %T: %v", i, inElem, inElem)
-			}
-			st, ok := registry[inElem.Tag]
-			if !ok {
-				return fmt.Errorf("tag %v not found in registry, value: %v", inElem.Tag, inElem.Value)
-			}
+	for i, e := range in {
+		// Elements with a registered tag are instantiated as pointers to
+		// the registered struct when the slice holds interfaces.
+		if st, ok := registry[e.Tag]; ok && out.Type().Elem().Kind() == reflect.Interface && st.Kind() == reflect.Struct {
 			inst := reflect.New(st)
+			if !inst.Type().AssignableTo(out.Type().Elem()) {
+				return fmt.Errorf("idx %d: registered type %v is not assignable to %v", i, inst.Type(), out.Type().Elem())
+			}
 			childScs := structCBORSpec{}
 			if err := childScs.learnStruct(st); err != nil {
 				return err
 			}
-			if err := childScs.convertStringMapToStruct(te, inst.Elem(), registry); err != nil {
-				return err
+			if err := childScs.convertMapToStruct(e.Value, inst.Elem(), registry); err != nil {
+				return fmt.Errorf("idx %d: %v", i, err)
 			}
 			out.Index(i).Set(inst)
+			continue
+		}
+		if err := scs.handleElement(out.Index(i), e, registry); err != nil {
+			return fmt.Errorf("index %d: %w", i, err)
 		}
-	default:
-		return fmt.Errorf("unsupported slice type: %v", k)
 	}
 	return nil
 }
 
-func (scs *structCBORSpec) handleArray(out reflect.Value, in TaggedElement) error {
+// handleArray sets the fixed-size array referenced by out to the elements in
+// in, which must have the same length.
+func (scs *structCBORSpec) handleArray(out reflect.Value, in []TaggedElement, registry map[CBORTag]reflect.Type) error {
 	if out.Kind() != reflect.Array {
 		return fmt.Errorf("called handleArray on non-array type: %v", out.Kind())
 	}
-	switch out.Type().Elem().Kind() {
-	case reflect.Uint64, reflect.String:
-		for i, e := range in.Value.([]TaggedElement) {
-			out.Index(i).Set(reflect.ValueOf(e.Value))
-		}
-	case reflect.Uint32:
-		for i, e := range in.Value.([]TaggedElement) {
-			dc := uint32(e.Value.(int))
-			out.Index(i).Set(reflect.ValueOf(dc))
-		}
-	case reflect.Uint16:
-		for i, e := range in.Value.([]TaggedElement) {
-			dc := uint16(e.Value.(int))
-			out.Index(i).Set(reflect.ValueOf(dc))
-		}
-	case reflect.Uint8:
-		for i, e := range in.Value.([]TaggedElement) {
-			dc := uint8(e.Value.(int))
-			out.Index(i).Set(reflect.ValueOf(dc))
+	if len(in) != out.Len() {
+		return fmt.Errorf("cannot read array of %d elements into %v", len(in), out.Type())
+	}
+	for i, e := range in {
+		if err := scs.handleElement(out.Index(i), e, registry); err != nil {
+			return fmt.Errorf("index %d: %w", i, err)
 		}
-	case reflect.Struct:
-		return fmt.Errorf("handleArray not yet implemented for type %T: %v", in.Value, in.Value)
 	}
 	return nil
 }
 
+// setByteArray copies b into out, a fixed-size array of the same length whose
+// elements are of type byte.
+func setByteArray(out reflect.Value, b []byte) error {
+	if len(b) != out.Len() {
+		return fmt.Errorf("cannot read %d bytes into %v", len(b), out.Type())
+	}
+	reflect.Copy(out, reflect.ValueOf(b))
+	return nil
+}
+
 // out must be a value of type struct. If the current thing is an interface then it should be
 // resolved to the actual type by the caller.
 func (scs *structCBORSpec) convertStringMapToStruct(in map[string]TaggedElement, out reflect.Value, registry map[CBORTag]reflect.Type) error {
 	if scs.strKeyForField == nil {
 		return fmt.Errorf("cant parse string map for struct type %s", out.Type().Name())
 	}
-	// Allocate the pointer if we were actually given a pointer to a struct.
-	// Then we set out to the indirect of that pointer to reuse our exisitng logic.
-	if out.Kind() == reflect.Ptr {
-		out.Set(reflect.New(out.Type().Elem()))
-		out = reflect.Indirect(out)
-	}
 	if out.Kind() != reflect.Struct {
 		return fmt.Errorf("cannot convertStringMapToStruct on non-struct: %v", out.Kind())
 	}
 	for i, n := 0, out.NumField(); i < n; i++ {
 		fieldName := out.Type().Field(i).Name
 		mapIdx := scs.strKeyForField[fieldName]
-		// If this is a struct we should do something special here.
 		if elem, ok := in[mapIdx]; ok {
-			// If this field is of type int but we have a uint64, we can cast
-			// it, provided that it fits.
-			if out.Field(i).Kind() == reflect.Int && reflect.ValueOf(elem.Value).Kind() == reflect.Uint64 {
-				elem.Value = int(elem.Value.(uint64))
+			if err := scs.handleElement(out.Field(i), elem, registry); err != nil {
+				return fmt.Errorf("field %s of %s: %w", fieldName, out.Type().Name(), err)
 			}
-			if out.Field(i).Kind() == reflect.Slice {
-				// We need to make a slice with the correct length and type.
-				slen := len(elem.Value.([]TaggedElement))
-				slice := reflect.MakeSlice(out.Field(i).Type(), slen, slen)
-				out.Field(i).Set(slice)
-				if err := scs.handleSlice(out.Field(i), elem.Value.([]TaggedElement), registry); err != nil {
-					return fmt.Errorf("convertStringMapToStruct failed to call handleSlice: %v", err)
-				}
-			} else if out.Field(i).Kind() == reflect.Array {
-				innerType := out.Field(i).Type().Elem()
-				arr := reflect.New(reflect.ArrayOf(len(elem.Value.([]TaggedElement)), innerType)).Elem()
-				out.Field(i).Set(arr)
-				if err := scs.handleArray(out.Field(i), elem); err != nil {
-					return fmt.Errorf("convertStringMapToStruct failed to call handleArray: %v", err)
-				}
-			} else if out.Field(i).Kind() == reflect.Struct {
-				childScs := structCBORSpec{}
-				childScs.learnStruct(out.Field(i).Type())
-				if err := childScs.convertStringMapToStruct(elem.Value.(map[string]TaggedElement), out.Field(i), registry); err != nil {
-					return fmt.Errorf("failed to convert map to struct for type %s: %v", out.Type().Name(), err)
+		} else {
+			// Do nothing if this field does was not specified in the map.
+		}
+	}
+	return nil
+}
+
+// handleElement sets the value referenced by out to the data in elem, as
+// read by CBORReader.Read, converting it to the type of out.
+func (scs *structCBORSpec) handleElement(out reflect.Value, elem TaggedElement, registry map[CBORTag]reflect.Type) error {
+	// The encoding of a value is gone once it has been read.
+	if out.Type() == rawType {
+		return fmt.Errorf("RawMessage can only be read straight from the input, not from a value returned by Read")
+	}
+	// Read returns false, true and null as Go values, but they are simple
+	// values 20, 21 and 22.
+	if out.Type() == simpleType && elem.Tag == CBORTag(0) {
+		switch v := elem.Value.(type) {
+		case bool:
+			if v {
+				out.SetUint(21)
+			} else {
+				out.SetUint(20)
+			}
+			return nil
+		case nil:
+			out.SetUint(22)
+			return nil
+		}
+	}
+	// Null sets pointers, slices, maps and interfaces to nil and addresses
+	// and dates to their zero value, and leaves other values unchanged.
+	if elem.Value == nil && elem.Tag == CBORTag(0) {
+		if isNullable(out.Type()) {
+			out.Set(reflect.Zero(out.Type()))
+		}
+		return nil
+	}
+	// Pointers are allocated unless they already point somewhere.
+	if out.Kind() == reflect.Ptr && !isConvertedType(out.Type()) {
+		if out.IsNil() {
+			out.Set(reflect.New(out.Type().Elem()))
+		}
+		return scs.handleElement(out.Elem(), elem, registry)
+	}
+	// A tagged null has no content to convert, except into an empty
+	// interface, which it leaves unchanged.
+	if elem.Value == nil && !isConvertedType(out.Type()) {
+		if _, ok := registry[elem.Tag]; !ok && out.Kind() == reflect.Interface && out.Type().NumMethod() == 0 {
+			return nil
+		}
+		return fmt.Errorf("cannot convert null with tag %d to %v", elem.Tag, out.Type())
+	}
+	// Integers of any size are stored in integer fields, provided that
+	// they fit. Other numbers are not converted to integers, nor integers
+	// to strings.
+	if isIntegerKind(out.Kind()) && isIntegerValue(elem.Value) {
+		return setInteger(out, elem.Value)
+	}
+	if isIntegerKind(out.Kind()) && !isConvertedType(out.Type()) && reflect.TypeOf(elem.Value) != out.Type() ||
+		out.Kind() == reflect.String && isIntegerValue(elem.Value) {
+		return fmt.Errorf("cannot convert %T to %v", elem.Value, out.Type())
+	}
+	if isConvertedType(out.Type()) {
+		if err := setConverted(out, elem); err != nil {
+			return err
+		}
+	} else if b, ok := bytesFromElement(elem); ok && out.Kind() == reflect.Slice && out.Type().Elem() == byteType {
+		out.Set(reflect.ValueOf(b).Convert(out.Type()))
+	} else if out.Kind() == reflect.Slice {
+		in, ok := elem.Value.([]TaggedElement)
+		if !ok {
+			return fmt.Errorf("cannot convert %T to %v", elem.Value, out.Type())
+		}
+		// We need to make a slice with the correct length and type.
+		slice := reflect.MakeSlice(out.Type(), len(in), len(in))
+		out.Set(slice)
+		if err := scs.handleSlice(out, in, registry); err != nil {
+			return fmt.Errorf("failed to call handleSlice: %w", err)
+		}
+	} else if b, ok := bytesFromElement(elem); ok && out.Kind() == reflect.Array && out.Type().Elem() == byteType {
+		return setByteArray(out, b)
+	} else if out.Kind() == reflect.Array {
+		in, ok := elem.Value.([]TaggedElement)
+		if !ok {
+			return fmt.Errorf("cannot convert %T to %v", elem.Value, out.Type())
+		}
+		if err := scs.handleArray(out, in, registry); err != nil {
+			return fmt.Errorf("failed to call handleArray: %w", err)
+		}
+	} else if out.Kind() == reflect.Map {
+		if err := scs.handleMap(out, elem.Value, registry); err != nil {
+			return fmt.Errorf("failed to call handleMap: %v", err)
+		}
+	} else if out.Kind() == reflect.Struct {
+		childScs := structCBORSpec{}
+		if err := childScs.learnStruct(out.Type()); err != nil {
+			return fmt.Errorf("failed to learn struct: %v", err)
+		}
+		if elem.Tag != CBORTag(0) && !childScs.acceptsTag(elem.Tag, out.Type(), registry) {
+			return fmt.Errorf("CBOR tag %d does not match struct type %v", elem.Tag, out.Type())
+		}
+		if err := childScs.convertMapToStruct(elem.Value, out, registry); err != nil {
+			return fmt.Errorf("failed to convert map to struct for type %s: %v", out.Type().Name(), err)
+		}
+	} else if out.Kind() == reflect.Interface {
+		concrete, ok := registry[elem.Tag]
+		if !ok {
+			// Anything fits into an empty interface.
+			if out.Type().NumMethod() == 0 {
+				if elem.Value != nil {
+					out.Set(reflect.ValueOf(untagValue(elem.Value)))
 				}
-			} else if out.Field(i).Kind() == reflect.Interface {
-				concrete, ok := registry[elem.Tag]
+				return nil
+			}
+			return fmt.Errorf("unsupported tag %d, type %v", elem.Tag, out.Type())
+		}
+		inst := reflect.New(concrete)
+		if concrete.Kind() == reflect.Struct {
+			childScs := structCBORSpec{}
+			if err := childScs.learnStruct(concrete); err != nil {
+				return fmt.Errorf("failed to learn struct: %v", err)
+			}
+			if err := childScs.convertMapToStruct(elem.Value, inst.Elem(), registry); err != nil {
+				return err
+			}
+		} else if concrete.Kind() == reflect.Slice {
+			// If the type is directly assignable then just assign it.
+			val := reflect.ValueOf(elem.Value)
+			if inst.Kind() == reflect.Ptr && val.Kind() != reflect.Ptr {
+				inst = inst.Elem()
+			}
+			if val.Type().AssignableTo(inst.Type()) {
+				inst.Set(val)
+			} else if val.Type().ConvertibleTo(inst.Type()) {
+				conv := val.Convert(inst.Type())
+				inst.Set(conv)
+			} else {
+				iter, ok := elem.Value.([]TaggedElement)
 				if !ok {
-					return fmt.Errorf("field: %s, unsupported tag %d, type %v", fieldName, elem.Tag, out.Type().Name())
+					return fmt.Errorf("recieved type was not a slice, it was a %T", elem.Value)
 				}
-				inst := reflect.New(concrete)
-				if concrete.Kind() == reflect.Struct {
-					childScs := structCBORSpec{}
-					if err := childScs.learnStruct(concrete); err != nil {
-						return fmt.Errorf("failed to learn struct: %v", err)
-					}
-					if err := childScs.convertStringMapToStruct(elem.Value.(map[string]TaggedElement), inst.Elem(), registry); err != nil {
-						return err
-					}
-				} else if concrete.Kind() == reflect.Slice {
-					// If the type is directly assignable then just assign it.
-					val := reflect.ValueOf(elem.Value)
-					if inst.Kind() == reflect.Ptr && val.Kind() != reflect.Ptr {
-						inst = inst.Elem()
-					}
-					if val.Type().AssignableTo(inst.Type()) {
-						inst.Set(val)
-					} else if val.Type().ConvertibleTo(inst.Type()) {
-						conv := val.Convert(inst.Type())
-						inst.Set(conv)
-					} else {
-						iter, ok := elem.Value.([]TaggedElement)
-						if !ok {
-							return fmt.Errorf("recieved type was not a slice, it was a %T", elem.Value)
-						}
-						inst = reflect.MakeSlice(concrete, len(iter), len(iter))
-						if err := scs.handleSlice(inst, iter, registry); err != nil {
-							return fmt.Errorf("failed to handleSlice: %v", err)
-						}
-					}
-				} else {
-					val := reflect.ValueOf(elem.Value)
-					if inst.Kind() == reflect.Ptr && val.Kind() != reflect.Ptr {
-						inst = inst.Elem()
-					}
-					// Check assignability
-					inType := val.Type()
-					outType := inst.Type()
-					if inType.AssignableTo(outType) {
-						inst.Set(val)
-					} else if inType.ConvertibleTo(outType) {
-						converted := val.Convert(outType)
-						inst.Set(converted)
-					} else {
-						return fmt.Errorf("could not assign %v to %v", inType, outType)
-					}
-				}
-				if inst.Kind() == reflect.Ptr {
-					inst = inst.Elem()
+				inst = reflect.MakeSlice(concrete, len(iter), len(iter))
+				if err := scs.handleSlice(inst, iter, registry); err != nil {
+					return fmt.Errorf("failed to handleSlice: %v", err)
 				}
-				out.Field(i).Set(inst)
+			}
+		} else {
+			val := reflect.ValueOf(elem.Value)
+			if inst.Kind() == reflect.Ptr && val.Kind() != reflect.Ptr {
+				inst = inst.Elem()
+			}
+			// Check assignability
+			inType := val.Type()
+			outType := inst.Type()
+			if inType.AssignableTo(outType) {
+				inst.Set(val)
+			} else if inType.ConvertibleTo(outType) {
+				converted := val.Convert(outType)
+				inst.Set(converted)
 			} else {
-				val := reflect.ValueOf(elem.Value)
-				// Check assignability
-				inType := val.Type()
-				outType := out.Field(i).Type()
-				if inType.AssignableTo(outType) {
-					out.Field(i).Set(val)
-				} else if inType.ConvertibleTo(outType) {
-					converted := val.Convert(outType)
-					out.Field(i).Set(converted)
-				} else {
-					return fmt.Errorf("could not assign %v to %v", inType, outType)
-				}
+				return fmt.Errorf("could not assign %v to %v", inType, outType)
 			}
+		}
+		if inst.Kind() == reflect.Ptr {
+			inst = inst.Elem()
+		}
+		out.Set(inst)
+	} else {
+		val := reflect.ValueOf(elem.Value)
+		// Check assignability
+		inType := val.Type()
+		outType := out.Type()
+		if inType.AssignableTo(outType) {
+			out.Set(val)
+		} else if inType.ConvertibleTo(outType) {
+			converted := val.Convert(outType)
+			out.Set(converted)
 		} else {
-			// Do nothing if this field does was not specified in the map.
+			return fmt.Errorf("could not assign %v to %v", inType, outType)
 		}
 	}
 	return nil
 }
+
+// handleMap sets the map referenced by out to the data in in, which should be
+// a map as returned by CBORReader.Read. The map is allocated if it is nil, and
+// keys and values are converted to the key and element types of out.
+func (scs *structCBORSpec) handleMap(out reflect.Value, in interface{}, registry map[CBORTag]reflect.Type) error {
+	if out.Kind() != reflect.Map {
+		return fmt.Errorf("called handleMap on non-map type: %v", out.Kind())
+	}
+	if out.IsNil() {
+		out.Set(reflect.MakeMap(out.Type()))
+	}
+	set := func(k interface{}, e TaggedElement) error {
+		key, err := convertMapKey(k, out.Type().Key())
+		if err != nil {
+			return err
+		}
+		val := reflect.New(out.Type().Elem()).Elem()
+		if err := scs.handleElement(val, e, registry); err != nil {
+			return fmt.Errorf("map key %v: %v", k, err)
+		}
+		out.SetMapIndex(key, val)
+		return nil
+	}
+	switch m := in.(type) {
+	case map[string]TaggedElement:
+		for k, e := range m {
+			if err := set(k, e); err != nil {
+				return err
+			}
+		}
+	case map[int]TaggedElement:
+		for k, e := range m {
+			if err := set(k, e); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot convert %T to %v", in, out.Type())
+	}
+	return nil
+}
+
+// convertMapKey converts a map key as returned by CBORReader.Read to type t.
+// Read coerces all keys but integers to strings, so strings are parsed
+// according to the kind of t.
+func convertMapKey(k interface{}, t reflect.Type) (reflect.Value, error) {
+	val := reflect.ValueOf(k)
+	if s, ok := k.(string); ok {
+		var parsed interface{}
+		var err error
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			parsed, err = strconv.ParseInt(s, 10, t.Bits())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			parsed, err = strconv.ParseUint(s, 10, t.Bits())
+		case reflect.Float32, reflect.Float64:
+			parsed, err = strconv.ParseFloat(s, t.Bits())
+		case reflect.Bool:
+			parsed, err = strconv.ParseBool(s)
+		default:
+			parsed = s
+		}
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("cannot convert map key %q to %v: %v", s, t, err)
+		}
+		val = reflect.ValueOf(parsed)
+	} else if isIntegerValue(k) {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			key := reflect.New(t).Elem()
+			if err := setInteger(key, k); err != nil {
+				return reflect.Value{}, fmt.Errorf("map key: %w", err)
+			}
+			return key, nil
+		case reflect.String:
+			// Converting an int to a string would yield a rune.
+			val = reflect.ValueOf(fmt.Sprint(k))
+		}
+	}
+	if val.Type().AssignableTo(t) {
+		return val, nil
+	}
+	if val.Type().ConvertibleTo(t) {
+		return val.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot convert map key %v to %v", k, t)
+}
@@ -1,12 +1,25 @@
 package borat
 
+import "fmt"
+
 const (
 	TagDateTimeString = 0
 	TagDateTimeEpoch  = 1
+	TagPosBignum      = 2
+	TagNegBignum      = 3
+	TagDecimal        = 4
+	TagBigFloat       = 5
+	TagEmbedded       = 24
 	TagURI            = 32
 	TagBase64URL      = 33
 	TagBase64         = 34
 	TagUUID           = 37
+	TagIPv4           = 52
+	TagIPv6           = 54
+	TagSelfDescribe   = 55799
+	TagDateEpochDays  = 100
+	TagExtendedTime   = 1001
+	TagDateString     = 1004
 )
 
 type CBORTag uint
@@ -22,4 +35,56 @@ const (
 	majorOther    = 0xe0
 	majorMask     = 0x1f
 	majorSelect   = 0xe0
+
+	// additional information marking an indefinite-length item
+	indefiniteLength = 0x1f
+	// stop code terminating an indefinite-length item
+	breakCode = 0xff
 )
+
+// SimpleValue is a CBOR simple value of major type 7. Values 20 to 23 are
+// false, true, null and undefined, and 24 to 31 are reserved.
+type SimpleValue uint8
+
+// Undefined is the simple value undefined, which Read returns for 0xf7.
+const Undefined SimpleValue = 23
+
+// isReservedSimple reports whether v may not be encoded as a simple value.
+func isReservedSimple(v uint64) bool {
+	return v >= 24 && v < 32
+}
+
+// MajorType is the major type of a CBOR item, from the top three bits of its
+// initial byte.
+type MajorType byte
+
+const (
+	MajorTypeUnsigned MajorType = iota
+	MajorTypeNegative
+	MajorTypeBytes
+	MajorTypeString
+	MajorTypeArray
+	MajorTypeMap
+	MajorTypeTag
+	MajorTypeOther
+)
+
+var majorTypeNames = []string{"unsigned", "negative", "bytes", "string", "array", "map", "tag", "other"}
+
+func (m MajorType) String() string {
+	if int(m) < len(majorTypeNames) {
+		return majorTypeNames[m]
+	}
+	return fmt.Sprintf("MajorType(%d)", byte(m))
+}
+
+// selfDescribe is the encoding of the self-describe tag 55799, which marks
+// data as CBOR without changing its meaning.
+var selfDescribe = []byte{0xd9, 0xd9, 0xf7}
+
+// IsCBOR reports whether prefix, the first bytes of some data, starts with
+// the self-describe tag and so is recognizably CBOR.
+func IsCBOR(prefix []byte) bool {
+	return len(prefix) >= len(selfDescribe) &&
+		prefix[0] == selfDescribe[0] && prefix[1] == selfDescribe[1] && prefix[2] == selfDescribe[2]
+}
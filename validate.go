@@ -0,0 +1,190 @@
+package borat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Errors returned by Validate, wrapped in a DeterministicEncodingError, for
+// each of the core deterministic encoding rules of RFC 8949 section 4.2.1.
+var (
+	NonMinimalHeadError   = errors.New("integer or length not encoded in its shortest form")
+	IndefiniteLengthError = errors.New("indefinite length item")
+	NonShortestFloatError = errors.New("float not encoded in its shortest form")
+	UnsortedMapKeysError  = errors.New("map keys not sorted")
+	DuplicateMapKeyError  = errors.New("duplicate map key")
+)
+
+// DeterministicEncodingError reports which rule an encoding broke, and the
+// byte offset of the offending item.
+type DeterministicEncodingError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *DeterministicEncodingError) Error() string {
+	return fmt.Sprintf("cbor: %v at offset %d", e.Err, e.Offset)
+}
+
+func (e *DeterministicEncodingError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks that data holds one or more well-formed CBOR items which
+// are encoded according to the core deterministic encoding rules: minimal
+// heads, definite lengths, shortest floats and map keys sorted bytewise
+// without duplicates. This is the form produced by a CBORWriter in
+// EncodingModeCoreDeterministic. Arrays, maps and tags may be nested at most
+// validateDepthLimit deep; deeper nesting returns DepthLimitError.
+func Validate(data []byte) error {
+	v := validator{r: NewCBORReader(bytes.NewReader(data)), data: data}
+	v.r.SetDepthLimit(validateDepthLimit)
+	for {
+		if err := v.item(); err != nil {
+			return err
+		}
+		if v.r.offset == int64(len(data)) {
+			return nil
+		}
+	}
+}
+
+// validateDepthLimit bounds the nesting Validate accepts, so that hostile
+// input cannot exhaust the stack.
+const validateDepthLimit = 1024
+
+type validator struct {
+	r    *CBORReader
+	data []byte
+}
+
+func (v *validator) fail(offset int64, err error) error {
+	return &DeterministicEncodingError{Offset: offset, Err: err}
+}
+
+// item validates the next item and everything nested in it.
+func (v *validator) item() error {
+	start := v.r.offset
+	ct, err := v.r.readType()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	v.r.pushbackType(ct)
+
+	mt := ct & majorSelect
+	if mt == majorNegative {
+		mt = majorUnsigned
+	}
+	u, _, _, err := v.r.readBasicUnsigned(mt)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return v.fail(start, err)
+	}
+
+	ai := ct & majorMask
+	if ai == indefiniteLength {
+		if ct == breakCode {
+			return v.fail(start, InvalidCBORError)
+		}
+		return v.fail(start, IndefiniteLengthError)
+	}
+
+	if ct&majorSelect == majorOther {
+		return v.checkOther(start, ai, u)
+	}
+
+	if !minimalHead(ai, u) {
+		return v.fail(start, NonMinimalHeadError)
+	}
+
+	switch ct & majorSelect {
+	case majorArray, majorMap, majorTag:
+		if err := v.r.enter(); err != nil {
+			return err
+		}
+		defer v.r.leave()
+	}
+
+	switch ct & majorSelect {
+	case majorBytes, majorString:
+		if u > uint64(len(v.data)) {
+			return io.ErrUnexpectedEOF
+		}
+		return v.r.readFull(make([]byte, u))
+	case majorArray:
+		for i := uint64(0); i < u; i++ {
+			if err := v.item(); err != nil {
+				return err
+			}
+		}
+	case majorMap:
+		var prev []byte
+		for i := uint64(0); i < u; i++ {
+			keyStart := v.r.offset
+			if err := v.item(); err != nil {
+				return err
+			}
+			key := v.data[keyStart:v.r.offset]
+			if i > 0 {
+				switch c := bytes.Compare(prev, key); {
+				case c == 0:
+					return v.fail(keyStart, DuplicateMapKeyError)
+				case c > 0:
+					return v.fail(keyStart, UnsortedMapKeysError)
+				}
+			}
+			prev = key
+			if err := v.item(); err != nil {
+				return err
+			}
+		}
+	case majorTag:
+		return v.item()
+	}
+	return nil
+}
+
+// checkOther validates a float or simple value.
+func (v *validator) checkOther(start int64, ai byte, u uint64) error {
+	switch ai {
+	case 24:
+		// simple values below 32 must use the one byte form
+		if u < 32 {
+			return v.fail(start, NonMinimalHeadError)
+		}
+	case 26:
+		f := float64(math.Float32frombits(uint32(u)))
+		if _, ok := float64ToFloat16(f); ok {
+			return v.fail(start, NonShortestFloatError)
+		}
+	case 27:
+		f := math.Float64frombits(u)
+		if _, ok := float64ToFloat32(f); ok {
+			return v.fail(start, NonShortestFloatError)
+		}
+	}
+	return nil
+}
+
+// minimalHead reports whether u could not have been encoded in a shorter head.
+func minimalHead(ai byte, u uint64) bool {
+	switch ai {
+	case 24:
+		return u > 23
+	case 25:
+		return u > math.MaxUint8
+	case 26:
+		return u > math.MaxUint16
+	case 27:
+		return u > math.MaxUint32
+	}
+	return true
+}
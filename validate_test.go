@@ -0,0 +1,90 @@
+package borat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := [][]byte{
+		{0x00},
+		{0x18, 0x18},
+		{0x39, 0x01, 0x00},
+		{0x62, 0x68, 0x69},
+		{0x82, 0x01, 0x02},
+		{0xa2, 0x01, 0x02, 0x61, 0x61, 0x03},
+		{0xc1, 0x1a, 0x5a, 0x21, 0x3a, 0x00},
+		{0xf9, 0x3c, 0x00},
+		{0xfa, 0x47, 0xc3, 0x50, 0x00},
+		{0xfb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a},
+		{0xf8, 0x20},
+		{0x01, 0x02},
+	}
+	for _, in := range valid {
+		if err := Validate(in); err != nil {
+			t.Errorf("Validate(% x): unexpected error %v", in, err)
+		}
+	}
+
+	invalid := []struct {
+		in     []byte
+		err    error
+		offset int64
+	}{
+		{[]byte{0x18, 0x17}, NonMinimalHeadError, 0},
+		{[]byte{0x82, 0x01, 0x19, 0x00, 0xff}, NonMinimalHeadError, 2},
+		{[]byte{0x5f, 0x41, 0x00, 0xff}, IndefiniteLengthError, 0},
+		{[]byte{0x81, 0x9f, 0xff}, IndefiniteLengthError, 1},
+		{[]byte{0xfa, 0x3f, 0x80, 0x00, 0x00}, NonShortestFloatError, 0},
+		{[]byte{0xfb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, NonShortestFloatError, 0},
+		{[]byte{0xa2, 0x61, 0x61, 0x01, 0x01, 0x02}, UnsortedMapKeysError, 4},
+		{[]byte{0xa2, 0x01, 0x01, 0x01, 0x02}, DuplicateMapKeyError, 3},
+		{[]byte{0xf8, 0x10}, NonMinimalHeadError, 0},
+		{[]byte{0x1c}, InvalidCBORError, 0},
+		{[]byte{0x82, 0x01, 0xfe}, InvalidCBORError, 2},
+		{[]byte{0x81, 0x19, 0x01}, io.ErrUnexpectedEOF, 1},
+	}
+	for _, c := range invalid {
+		err := Validate(c.in)
+		var de *DeterministicEncodingError
+		if !errors.As(err, &de) || !errors.Is(err, c.err) || de.Offset != c.offset {
+			t.Errorf("Validate(% x): expected %v at offset %d, got %v", c.in, c.err, c.offset, err)
+		}
+	}
+
+	if err := Validate([]byte{0x82, 0x01}); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF for truncated input, got %v", err)
+	}
+}
+
+func TestValidateDepth(t *testing.T) {
+	for _, b := range []byte{0x81, 0xc6} {
+		in := append(bytes.Repeat([]byte{b}, 1<<20), 0x01)
+		if err := Validate(in); err != DepthLimitError {
+			t.Errorf("nested % x: expected %v, got %v", b, DepthLimitError, err)
+		}
+	}
+	in := append(bytes.Repeat([]byte{0x81}, validateDepthLimit), 0x01)
+	if err := Validate(in); err != nil {
+		t.Errorf("expected nesting up to the limit to validate, got %v", err)
+	}
+}
+
+func TestValidateWriterOutput(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCBORWriter(&buf)
+	w.SetEncodingMode(EncodingModeCoreDeterministic)
+	in := map[string]interface{}{
+		"zz": 1.5,
+		"a":  []int{1, 300, -70000},
+		"b":  map[int]string{10: "x", -1: "y", 100: "z"},
+	}
+	if err := w.Marshal(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(buf.Bytes()); err != nil {
+		t.Fatalf("deterministic writer output did not validate: %v", err)
+	}
+}
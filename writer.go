@@ -1,10 +1,15 @@
 package borat
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
 	"reflect"
 	"sort"
 	"time"
@@ -14,12 +19,50 @@ import (
 type DateTimePref int
 
 const (
-	// DateTimePrefInt causes a timestamp to be encoded as an int.
-	DateTimePrefInt = iota
-	// DateTimePrefFloat causes a timestamp to be encoded as a float.
+	// DateTimePrefInt causes a timestamp to be encoded as an int number of
+	// seconds since the epoch with tag 1, dropping any fraction of a second.
+	DateTimePrefInt DateTimePref = iota
+	// DateTimePrefFloat causes a timestamp to be encoded as a float number of
+	// seconds since the epoch with tag 1. Doubles only hold about microsecond
+	// precision for current dates.
 	DateTimePrefFloat
-	// DateTimePrefString causes a timestamp to be encoded as a String.
+	// DateTimePrefString causes a timestamp to be encoded as an RFC 3339
+	// string with tag 0, keeping nanoseconds and the time zone offset.
 	DateTimePrefString
+	// DateTimePrefExtended causes a timestamp to be encoded as an RFC 9581
+	// extended time with tag 1001, keeping nanoseconds and a time zone hint.
+	DateTimePrefExtended
+)
+
+// FloatPref indicates the format for writing floating point numbers.
+type FloatPref int
+
+const (
+	// FloatPrefDouble causes floats to always be encoded as 64-bit doubles.
+	FloatPrefDouble FloatPref = iota
+	// FloatPrefShortest causes floats to be encoded as the shortest of
+	// half, single or double precision that represents the value exactly.
+	FloatPrefShortest
+)
+
+// EncodingMode selects the rules a CBORWriter follows to make its output
+// deterministic.
+type EncodingMode int
+
+const (
+	// EncodingModeDefault writes map keys in the natural order of their Go
+	// values, and follows the floating point and streaming preferences set
+	// on the writer.
+	EncodingModeDefault EncodingMode = iota
+	// EncodingModeCoreDeterministic implements the core deterministic
+	// encoding requirements of RFC 8949 section 4.2.1: integers, lengths and
+	// floats in their shortest form, no indefinite-length items, and map
+	// keys sorted in the bytewise lexicographic order of their encodings.
+	EncodingModeCoreDeterministic
+	// EncodingModeLengthFirst implements the canonical CBOR of RFC 7049
+	// section 3.9, which differs from EncodingModeCoreDeterministic in
+	// sorting shorter map keys first.
+	EncodingModeLengthFirst
 )
 
 // CBORWriter writes CBOR to an output stream. It provides a relatively
@@ -28,9 +71,24 @@ const (
 // properly encode arbitrary objects as CBOR.
 type CBORWriter struct {
 	dateTimePref DateTimePref
+	floatPref    FloatPref
+	encodingMode EncodingMode
+	selfDescribe bool // Write the self-describe tag before the first item.
+	described    bool
 	out          io.Writer
 	scsCache     map[reflect.Type]*structCBORSpec
 	regTags      map[reflect.Type]CBORTag
+	stack        []streamFrame
+}
+
+// streamFrame records a container that is still open while an
+// indefinite-length item is being written, so that misplaced items and
+// unbalanced calls to End can be detected.
+type streamFrame struct {
+	mt         byte
+	indefinite bool
+	remaining  uint64 // items still to come in a definite-length container
+	items      uint64 // items written so far into an indefinite-length one
 }
 
 // NewCBORWriter creates a new CBORWriter around a given output stream
@@ -38,6 +96,8 @@ type CBORWriter struct {
 func NewCBORWriter(out io.Writer) *CBORWriter {
 	w := &CBORWriter{
 		dateTimePref: DateTimePrefInt,
+		floatPref:    FloatPrefDouble,
+		encodingMode: EncodingModeDefault,
 		out:          out,
 		scsCache:     make(map[reflect.Type]*structCBORSpec),
 		regTags:      make(map[reflect.Type]CBORTag),
@@ -55,17 +115,101 @@ func (w *CBORWriter) RegisterCBORTag(tag CBORTag, inst interface{}) error {
 	return nil
 }
 
+// startItem records the start of an item with major type mt in the
+// enclosing containers. n is the length of an array or map. Tracking only
+// happens while an indefinite-length item is open, since definite-length
+// items are always written completely by a single call.
+func (w *CBORWriter) startItem(mt byte, n uint64, indefinite bool) error {
+	if w.selfDescribe && !w.described {
+		w.described = true
+		if _, err := w.out.Write(selfDescribe); err != nil {
+			return err
+		}
+	}
+
+	if len(w.stack) == 0 && !indefinite {
+		return nil
+	}
+
+	if len(w.stack) > 0 {
+		top := &w.stack[len(w.stack)-1]
+		if top.indefinite && (top.mt == majorBytes || top.mt == majorString) &&
+			(mt != top.mt || indefinite) {
+			return fmt.Errorf("only definite-length chunks of major type %d may be written into an indefinite-length string", top.mt>>5)
+		}
+		if top.indefinite {
+			top.items++
+		} else {
+			top.remaining--
+		}
+	}
+
+	switch {
+	case indefinite:
+		w.stack = append(w.stack, streamFrame{mt: mt, indefinite: true})
+	case mt == majorArray && n > 0:
+		w.stack = append(w.stack, streamFrame{mt: mt, remaining: n})
+	case mt == majorMap && n > 0:
+		w.stack = append(w.stack, streamFrame{mt: mt, remaining: 2 * n})
+	case mt == majorTag:
+		w.stack = append(w.stack, streamFrame{mt: mt, remaining: 1})
+	default:
+		w.endItem()
+	}
+	return nil
+}
+
+// endItem closes all definite-length containers that have been completed by
+// the item just written.
+func (w *CBORWriter) endItem() {
+	for len(w.stack) > 0 {
+		top := w.stack[len(w.stack)-1]
+		if top.indefinite || top.remaining > 0 {
+			return
+		}
+		w.stack = w.stack[:len(w.stack)-1]
+	}
+}
+
+// SetDateTimePref sets the format used for writing timestamps. The default is
+// DateTimePrefInt.
+func (w *CBORWriter) SetDateTimePref(p DateTimePref) {
+	w.dateTimePref = p
+}
+
+// SetSelfDescribe selects whether the output starts with the self-describe
+// tag 55799, so that files holding it are recognizable as CBOR. The tag is
+// written once, in front of the first item.
+func (w *CBORWriter) SetSelfDescribe(selfDescribe bool) {
+	w.selfDescribe = selfDescribe
+}
+
+// SetFloatPref sets the format used by WriteFloat.
+func (w *CBORWriter) SetFloatPref(p FloatPref) {
+	w.floatPref = p
+}
+
+// SetEncodingMode sets the rules for deterministic encoding. Any mode but
+// EncodingModeDefault overrides the floating point preference.
+func (w *CBORWriter) SetEncodingMode(m EncodingMode) {
+	w.encodingMode = m
+}
+
 func (w *CBORWriter) writeBasicInt(u uint64, mt byte) error {
+	if err := w.startItem(mt, u, false); err != nil {
+		return err
+	}
+
 	var out []byte
 
 	if u < 24 {
 		out = []byte{mt | byte(u)}
-	} else if u < math.MaxUint8 {
+	} else if u <= math.MaxUint8 {
 		out = []byte{mt | 24, byte(u)}
-	} else if u < math.MaxUint16 {
+	} else if u <= math.MaxUint16 {
 		out = []byte{mt | 25, 0, 0}
 		binary.BigEndian.PutUint16(out[1:3], uint16(u))
-	} else if u < math.MaxUint32 {
+	} else if u <= math.MaxUint32 {
 		out = []byte{mt | 26, 0, 0, 0, 0}
 		binary.BigEndian.PutUint32(out[1:5], uint32(u))
 	} else {
@@ -97,11 +241,91 @@ func (w *CBORWriter) WriteInt(i int) error {
 	return w.writeBasicInt(u, mt)
 }
 
+// WriteBigInt writes an arbitrary precision integer to the output stream. Values
+// which fit into 64 bits are written as plain integers, all others as bignums
+// with tag 2 or 3.
+func (w *CBORWriter) WriteBigInt(b *big.Int) error {
+	if b == nil {
+		return fmt.Errorf("cannot write nil big.Int")
+	}
+	if b.Sign() >= 0 {
+		if b.IsUint64() {
+			return w.writeBasicInt(b.Uint64(), majorUnsigned)
+		}
+		if err := w.WriteTag(TagPosBignum); err != nil {
+			return err
+		}
+		return w.WriteBytes(b.Bytes())
+	}
+
+	// negative values are encoded as -1 - n
+	n := new(big.Int).Neg(b)
+	n.Sub(n, big.NewInt(1))
+	if n.IsUint64() {
+		return w.writeBasicInt(n.Uint64(), majorNegative)
+	}
+	if err := w.WriteTag(TagNegBignum); err != nil {
+		return err
+	}
+	return w.WriteBytes(n.Bytes())
+}
+
+// writeMantExp writes a number tagged with tag, which is either TagDecimal or
+// TagBigFloat, as its exponent and mantissa.
+func (w *CBORWriter) writeMantExp(tag CBORTag, m *big.Int, exp int) error {
+	if err := w.WriteTag(tag); err != nil {
+		return err
+	}
+	if err := w.writeBasicInt(2, majorArray); err != nil {
+		return err
+	}
+	if err := w.WriteInt(exp); err != nil {
+		return err
+	}
+	if m == nil {
+		m = new(big.Int)
+	}
+	return w.WriteBigInt(m)
+}
+
+// WriteDecimal writes a decimal fraction with tag 4 to the output stream.
+func (w *CBORWriter) WriteDecimal(d Decimal) error {
+	return w.writeMantExp(TagDecimal, d.Mantissa, d.Exponent)
+}
+
+// WriteBigFloat writes an arbitrary precision float with tag 5 to the output
+// stream. Infinite values cannot be written.
+func (w *CBORWriter) WriteBigFloat(f *big.Float) error {
+	if f == nil {
+		return fmt.Errorf("cannot write nil big.Float")
+	}
+	m, exp, err := bigFloatMantExp(f)
+	if err != nil {
+		return err
+	}
+	return w.writeMantExp(TagBigFloat, m, exp)
+}
+
 // WriteFloat writes a floating point number to the output stream.
 func (w *CBORWriter) WriteFloat(f float64) error {
-	out := []byte{majorOther | 27, 0, 0, 0, 0, 0, 0, 0, 0}
-	u := math.Float64bits(f)
-	binary.BigEndian.PutUint64(out[1:9], u)
+	if err := w.startItem(majorOther, 0, false); err != nil {
+		return err
+	}
+
+	var out []byte
+	if w.floatPref == FloatPrefShortest || w.encodingMode != EncodingModeDefault {
+		if h, ok := float64ToFloat16(f); ok {
+			out = []byte{majorOther | 25, 0, 0}
+			binary.BigEndian.PutUint16(out[1:3], h)
+		} else if f32, ok := float64ToFloat32(f); ok {
+			out = []byte{majorOther | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(out[1:5], math.Float32bits(f32))
+		}
+	}
+	if out == nil {
+		out = []byte{majorOther | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(out[1:9], math.Float64bits(f))
+	}
 
 	_, err := w.out.Write(out)
 	return err
@@ -128,6 +352,10 @@ func (w *CBORWriter) WriteString(s string) error {
 
 // WriteBool writes a boolean value to the output stream.
 func (w *CBORWriter) WriteBool(b bool) error {
+	if err := w.startItem(majorOther, 0, false); err != nil {
+		return err
+	}
+
 	out := []byte{0xf4}
 	if b {
 		out[0] = 0xf5
@@ -146,21 +374,226 @@ func (w *CBORWriter) WriteTime(t time.Time) error {
 		}
 		return w.WriteInt(int(t.Unix()))
 	case DateTimePrefFloat:
-		return fmt.Errorf("Unsupported")
+		if err := w.WriteTag(TagDateTimeEpoch); err != nil {
+			return err
+		}
+		return w.WriteFloat(float64(t.Unix()) + float64(t.Nanosecond())/1e9)
 	case DateTimePrefString:
-		return fmt.Errorf("Unsupported")
+		if err := w.WriteTag(TagDateTimeString); err != nil {
+			return err
+		}
+		return w.WriteString(t.Format(time.RFC3339Nano))
+	case DateTimePrefExtended:
+		if err := w.WriteTag(TagExtendedTime); err != nil {
+			return err
+		}
+		return w.WriteIntMap(extendedTimeMap(t))
 	default:
-		panic("Unsupported date time preference format.")
+		return fmt.Errorf("unsupported date time preference %d", w.dateTimePref)
+	}
+}
+
+// WriteURI writes a URI with tag 32 to the output stream. The URI must be
+// absolute.
+func (w *CBORWriter) WriteURI(u *url.URL) error {
+	if u == nil {
+		return fmt.Errorf("cannot write nil URL")
+	}
+	if !u.IsAbs() {
+		return fmt.Errorf("cannot write relative URL %v with tag %d", u, TagURI)
+	}
+	if err := w.WriteTag(TagURI); err != nil {
+		return err
+	}
+	return w.WriteString(u.String())
+}
+
+// WriteUUID writes a UUID with tag 37 to the output stream.
+func (w *CBORWriter) WriteUUID(u UUID) error {
+	if err := w.WriteTag(TagUUID); err != nil {
+		return err
+	}
+	return w.WriteBytes(u[:])
+}
+
+// WriteRaw writes an encoded item verbatim to the output stream, or null if
+// raw is empty. The item must be well-formed.
+func (w *CBORWriter) WriteRaw(raw RawMessage) error {
+	if len(raw) == 0 {
+		return w.WriteNil()
+	}
+	if err := checkWellFormed(raw); err != nil {
+		return fmt.Errorf("invalid RawMessage: %v", err)
 	}
+	return w.writeEncodedItem(raw)
+}
+
+// WriteEmbedded marshals x and writes its encoding as a byte string with tag
+// 24, so that it can be carried or signed as an opaque payload.
+func (w *CBORWriter) WriteEmbedded(x interface{}) error {
+	var buf bytes.Buffer
+	if err := w.subWriter(&buf).Marshal(x); err != nil {
+		return err
+	}
+	if err := w.WriteTag(TagEmbedded); err != nil {
+		return err
+	}
+	return w.WriteBytes(buf.Bytes())
+}
+
+// WriteAddr writes an IP address with tag 52 or 54 to the output stream.
+func (w *CBORWriter) WriteAddr(a netip.Addr) error {
+	b, err := addrBytes(a)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteTag(addrTag(a)); err != nil {
+		return err
+	}
+	return w.WriteBytes(b)
+}
+
+// WritePrefix writes an IP prefix with tag 52 or 54 to the output stream. A
+// prefix without bits set beyond its length is written in the compact prefix
+// form, and any other prefix in the interface form, as a full address
+// followed by the prefix length.
+func (w *CBORWriter) WritePrefix(p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("cannot encode invalid IP prefix")
+	}
+	a := p.Addr()
+	if _, err := addrBytes(a); err != nil {
+		return err
+	}
+	if err := w.WriteTag(addrTag(a)); err != nil {
+		return err
+	}
+	if err := w.writeBasicInt(2, majorArray); err != nil {
+		return err
+	}
+	if p.Masked() == p {
+		if err := w.WriteInt(p.Bits()); err != nil {
+			return err
+		}
+		return w.WriteBytes(prefixBytes(p))
+	}
+	if err := w.WriteBytes(a.AsSlice()); err != nil {
+		return err
+	}
+	return w.WriteInt(p.Bits())
+}
+
+// WriteDate writes a calendar date to the output stream, as a full-date string
+// with tag 1004 for DateTimePrefString, and as days since the epoch with tag
+// 100 otherwise. The zero Date is not a valid date and cannot be written.
+func (w *CBORWriter) WriteDate(d Date) error {
+	if d == (Date{}) {
+		return fmt.Errorf("cannot encode zero date")
+	}
+	if w.dateTimePref == DateTimePrefString {
+		if err := w.WriteTag(TagDateString); err != nil {
+			return err
+		}
+		return w.WriteString(d.String())
+	}
+	if err := w.WriteTag(TagDateEpochDays); err != nil {
+		return err
+	}
+	return w.WriteInt(int(d.daysSinceEpoch()))
 }
 
 // WriteNil writes a nil to the output stream
 func (w *CBORWriter) WriteNil() error {
+	if err := w.startItem(majorOther, 0, false); err != nil {
+		return err
+	}
+
 	out := []byte{0xf6}
 	_, err := w.out.Write(out)
 	return err
 }
 
+// WriteSimple writes a simple value to the output stream. The reserved values
+// 24 to 31 cannot be written.
+func (w *CBORWriter) WriteSimple(v SimpleValue) error {
+	if isReservedSimple(uint64(v)) {
+		return fmt.Errorf("cannot write reserved simple value %d", v)
+	}
+	return w.writeBasicInt(uint64(v), majorOther)
+}
+
+// WriteUndefined writes undefined to the output stream.
+func (w *CBORWriter) WriteUndefined() error {
+	return w.WriteSimple(Undefined)
+}
+
+func (w *CBORWriter) writeIndefinite(mt byte) error {
+	if w.encodingMode != EncodingModeDefault {
+		return fmt.Errorf("indefinite-length items are not allowed in deterministic encoding")
+	}
+	if err := w.startItem(mt, 0, true); err != nil {
+		return err
+	}
+
+	_, err := w.out.Write([]byte{mt | indefiniteLength})
+	return err
+}
+
+// BeginArray starts an indefinite-length array. Every item written after it
+// is an element of the array, up to the matching call to End.
+func (w *CBORWriter) BeginArray() error {
+	return w.writeIndefinite(majorArray)
+}
+
+// BeginMap starts an indefinite-length map. Items written after it are taken
+// as alternating keys and values, up to the matching call to End.
+func (w *CBORWriter) BeginMap() error {
+	return w.writeIndefinite(majorMap)
+}
+
+// BeginBytes starts an indefinite-length byte array. Only WriteBytes may be
+// called until the matching call to End; each call writes one chunk.
+func (w *CBORWriter) BeginBytes() error {
+	return w.writeIndefinite(majorBytes)
+}
+
+// BeginString starts an indefinite-length string. Only WriteString may be
+// called until the matching call to End; each call writes one chunk.
+func (w *CBORWriter) BeginString() error {
+	return w.writeIndefinite(majorString)
+}
+
+// End closes the innermost item started by BeginArray, BeginMap, BeginBytes
+// or BeginString by writing the break code.
+func (w *CBORWriter) End() error {
+	if len(w.stack) == 0 {
+		return fmt.Errorf("End called without a matching Begin")
+	}
+	top := w.stack[len(w.stack)-1]
+	if !top.indefinite {
+		return fmt.Errorf("End called inside an incomplete item of major type %d", top.mt>>5)
+	}
+	if top.mt == majorMap && top.items%2 != 0 {
+		return fmt.Errorf("End called on a map with a key but no value")
+	}
+	w.stack = w.stack[:len(w.stack)-1]
+	w.endItem()
+
+	_, err := w.out.Write([]byte{breakCode})
+	return err
+}
+
+// Finish checks that every item started by BeginArray, BeginMap, BeginBytes
+// or BeginString has been closed by End, and that no container is left
+// incomplete. It writes nothing.
+func (w *CBORWriter) Finish() error {
+	if len(w.stack) > 0 {
+		top := w.stack[len(w.stack)-1]
+		return fmt.Errorf("%d items left open, the innermost of major type %d", len(w.stack), top.mt>>5)
+	}
+	return nil
+}
+
 // WriteArray writes an arbitrary slice to the output stream. Each of the
 // elements of the array will be reflected and written as appropriate.
 func (w *CBORWriter) WriteArray(a []interface{}) error {
@@ -211,92 +644,44 @@ func (w *CBORWriter) WriteIntArray(a []int) error {
 // stream. Each of the values of the map will be reflected and written as
 // appropriate.
 func (w *CBORWriter) WriteStringMap(m map[string]interface{}) error {
-	if err := w.writeBasicInt(uint64(len(m)), majorMap); err != nil {
-		return err
-	}
-
-	// get sorted keys array
-	keys := make([]string, len(m))
-	i := 0
-	for k := range m {
-		keys[i] = k
-		i++
-	}
-	sort.Strings(keys)
-
-	// serialize based on ordered keys
-	for _, k := range keys {
-		if err := w.WriteString(k); err != nil {
-			return err
-		}
-		if err := w.Marshal(m[k]); err != nil {
+	entries := make([]mapEntry, 0, len(m))
+	for k, v := range m {
+		e, err := w.newMapEntry(reflect.ValueOf(k), v)
+		if err != nil {
 			return err
 		}
+		entries = append(entries, e)
 	}
-
-	return nil
+	return w.writeMapEntries(entries)
 }
 
 // writeTaggedStringMap writes a map where keys are optionally tagged.
 func (w *CBORWriter) writeTaggedStringMap(m map[string]TaggedElement) error {
-	if err := w.writeBasicInt(uint64(len(m)), majorMap); err != nil {
-		return err
-	}
-
-	// get sorted keys array
-	keys := make([]string, len(m))
-	i := 0
-	for k := range m {
-		keys[i] = k
-		i++
-	}
-	sort.Strings(keys)
-
-	// serialize based on ordered keys
-	for _, k := range keys {
-		if err := w.WriteString(k); err != nil {
-			return err
-		}
-		if m[k].Tag != CBORTag(0) {
-			if err := w.WriteTag(m[k].Tag); err != nil {
-				return err
-			}
-		}
-		if err := w.Marshal(m[k].Value); err != nil {
+	entries := make([]mapEntry, 0, len(m))
+	for k, v := range m {
+		e, err := w.newMapEntry(reflect.ValueOf(k), v.Value)
+		if err != nil {
 			return err
 		}
+		e.tag = v.Tag
+		entries = append(entries, e)
 	}
-	return nil
+	return w.writeMapEntries(entries)
 }
 
 // WriteIntMap writes a map keyed by integers to arbitrary types to the output
 // stream. Each of the values of the map will be reflected and written as
 // appropriate.
 func (w *CBORWriter) WriteIntMap(m map[int]interface{}) error {
-	if err := w.writeBasicInt(uint64(len(m)), majorMap); err != nil {
-		return err
-	}
-
-	// get sorted keys array
-	keys := make([]int, len(m))
-	i := 0
-	for k := range m {
-		keys[i] = k
-		i++
-	}
-	sort.Ints(keys)
-
-	// serialize based on ordered keys
-	for _, k := range keys {
-		if err := w.WriteInt(k); err != nil {
-			return err
-		}
-		if err := w.Marshal(m[k]); err != nil {
+	entries := make([]mapEntry, 0, len(m))
+	for k, v := range m {
+		e, err := w.newMapEntry(reflect.ValueOf(k), v)
+		if err != nil {
 			return err
 		}
+		entries = append(entries, e)
 	}
-
-	return nil
+	return w.writeMapEntries(entries)
 }
 
 // Marshal marshals an arbitrary object to the output stream using reflection.
@@ -305,35 +690,56 @@ func (w *CBORWriter) WriteIntMap(m map[int]interface{}) error {
 // object is a structure with CBOR struct tags, those struct tags will be used.
 // If the object is a struct without CBOR struct tags, the struct will be
 // marshaled as a map of strings to objects using the names of the public
-// members of the struct.
+// members of the struct. Nil pointers, slices, maps and interfaces are written
+// as null, except for struct members which are nil pointers or interfaces,
+// which are left out. Byte slices and arrays, including named types based on
+// them, are written as byte strings, unless a struct member has the array
+// option in its struct tag, as in `cbor:"key,array"`.
 func (w *CBORWriter) Marshal(x interface{}) error {
 
 	v := reflect.ValueOf(x)
 
+	// nil pointers, slices, maps and interfaces are written as null
+	if x == nil || (isNilKind(v.Kind()) && v.IsNil()) {
+		return w.WriteNil()
+	}
+
 	// if the type implements marshaler, just do that
 	if m, ok := x.(CBORMarshaler); ok {
 		return m.MarshalCBOR(w)
 	}
 
-	if v.Kind() == reflect.Ptr {
-		if inner := v.Elem(); inner.IsValid() {
-			return w.Marshal(inner.Interface())
-		}
-		return fmt.Errorf("invalid pointer: %v", v)
+	// big numbers have their own encodings
+	if b, ok := x.(*big.Int); ok {
+		return w.WriteBigInt(b)
+	}
+	if f, ok := x.(*big.Float); ok {
+		return w.WriteBigFloat(f)
+	}
+	if u, ok := x.(*url.URL); ok {
+		return w.WriteURI(u)
+	}
+	if raw, ok := x.(RawMessage); ok {
+		return w.WriteRaw(raw)
+	}
+	if sv, ok := x.(SimpleValue); ok {
+		return w.WriteSimple(sv)
 	}
 
-	if v.Kind() == reflect.Interface {
-		panic(fmt.Sprintf("this is an interface: %v", v.Type().Name()))
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		return w.Marshal(v.Elem().Interface())
 	}
 
 	// If this object is tagged in the registry then we should write a cbor tag first.
 	// Only do this if the value is non zero.
-	if x != nil && !reflect.DeepEqual(x, reflect.Zero(reflect.TypeOf(x)).Interface()) {
+	tagged := false
+	if !reflect.DeepEqual(x, reflect.Zero(reflect.TypeOf(x)).Interface()) {
 		t := v.Type()
 		if tag, ok := w.regTags[t]; ok {
 			if err := w.WriteTag(CBORTag(tag)); err != nil {
 				return err
 			}
+			tagged = true
 		}
 	}
 
@@ -342,6 +748,8 @@ func (w *CBORWriter) Marshal(x interface{}) error {
 		return w.WriteInt(int(v.Int()))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return w.writeBasicInt(v.Uint(), majorUnsigned)
+	case reflect.Float32, reflect.Float64:
+		return w.WriteFloat(v.Float())
 	case reflect.Bool:
 		return w.WriteBool(v.Bool())
 	case reflect.String:
@@ -349,13 +757,20 @@ func (w *CBORWriter) Marshal(x interface{}) error {
 	case reflect.Slice:
 		// treat byte slices specially
 		switch v.Type() {
-		case reflect.TypeOf([]byte{}):
-			return w.WriteBytes(v.Bytes())
+		case ipType:
+			a, ok := netip.AddrFromSlice(v.Bytes())
+			if !ok {
+				return fmt.Errorf("invalid IP address %v", v.Interface())
+			}
+			return w.WriteAddr(a.Unmap())
 		case reflect.TypeOf([]string{}):
 			return w.WriteStringArray(v.Interface().([]string))
 		case reflect.TypeOf([]int{}):
 			return w.WriteIntArray(v.Interface().([]int))
 		default:
+			if isByteSequence(v.Type()) {
+				return w.WriteBytes(v.Bytes())
+			}
 			iftype := make([]interface{}, v.Len())
 			for i := 0; i < v.Len(); i++ {
 				iftype[i] = v.Index(i).Interface()
@@ -363,17 +778,56 @@ func (w *CBORWriter) Marshal(x interface{}) error {
 			return w.WriteArray(iftype)
 		}
 	case reflect.Array:
+		if v.Type() == uuidType {
+			return w.WriteUUID(v.Interface().(UUID))
+		}
+		if isByteSequence(v.Type()) {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return w.WriteBytes(b)
+		}
 		s := make([]interface{}, v.Len())
 		for i := 0; i < v.Len(); i++ {
 			s[i] = v.Index(i).Interface()
 		}
 		return w.WriteArray(s)
+	case reflect.Map:
+		return w.writeReflectedMap(v)
 	case reflect.Struct:
 		// treat times sepcially
 		if v.Type() == reflect.TypeOf(time.Time{}) {
 			return w.WriteTime(v.Interface().(time.Time))
 		}
-		return w.writeReflectedStruct(v)
+		// unset addresses and dates have no encoding of their own
+		if isUnsetValue(v) {
+			return w.WriteNil()
+		}
+		switch v.Type() {
+		case bigIntType:
+			b := v.Interface().(big.Int)
+			return w.WriteBigInt(&b)
+		case bigFloatType:
+			f := v.Interface().(big.Float)
+			return w.WriteBigFloat(&f)
+		case decimalType:
+			return w.WriteDecimal(v.Interface().(Decimal))
+		case dateType:
+			return w.WriteDate(v.Interface().(Date))
+		case urlType:
+			u := v.Interface().(url.URL)
+			return w.WriteURI(&u)
+		case addrType:
+			return w.WriteAddr(v.Interface().(netip.Addr))
+		case prefixType:
+			return w.WritePrefix(v.Interface().(netip.Prefix))
+		case ipNetType:
+			p, err := prefixFromIPNet(v.Interface().(net.IPNet))
+			if err != nil {
+				return err
+			}
+			return w.WritePrefix(p)
+		}
+		return w.writeReflectedStruct(v, tagged)
 	case reflect.Invalid:
 		return fmt.Errorf("Trying to marshal Invalid: %v", v)
 	default:
@@ -381,16 +835,213 @@ func (w *CBORWriter) Marshal(x interface{}) error {
 	}
 }
 
-func (w *CBORWriter) writeReflectedStruct(v reflect.Value) error {
+// mapEntry is a map key together with its encoding and value, used for
+// ordering the entries of a map before writing it.
+type mapEntry struct {
+	key     reflect.Value
+	encoded []byte
+	tag     CBORTag
+	value   interface{}
+}
+
+// newMapEntry encodes the key k and returns a mapEntry for it. Plain string
+// and int keys are never tagged.
+func (w *CBORWriter) newMapEntry(k reflect.Value, v interface{}) (mapEntry, error) {
+	var buf bytes.Buffer
+	var err error
+	kw := w.subWriter(&buf)
+	switch key := k.Interface().(type) {
+	case string:
+		err = kw.WriteString(key)
+	case int:
+		err = kw.WriteInt(key)
+	default:
+		err = kw.Marshal(key)
+	}
+	if err != nil {
+		return mapEntry{}, err
+	}
+	return mapEntry{key: k, encoded: buf.Bytes(), value: v}, nil
+}
+
+// writeMapEntries sorts the entries of a map according to the encoding mode
+// and writes them.
+func (w *CBORWriter) writeMapEntries(entries []mapEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return w.lessMapKey(entries[i], entries[j])
+	})
+	if w.encodingMode != EncodingModeDefault {
+		for i := 1; i < len(entries); i++ {
+			if bytes.Equal(entries[i-1].encoded, entries[i].encoded) {
+				return fmt.Errorf("duplicate map key %v in deterministic encoding", entries[i].key)
+			}
+		}
+	}
+
+	if err := w.writeBasicInt(uint64(len(entries)), majorMap); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := w.writeEncodedItem(e.encoded); err != nil {
+			return err
+		}
+		if e.tag != CBORTag(0) {
+			if err := w.WriteTag(e.tag); err != nil {
+				return err
+			}
+		}
+		if err := w.Marshal(e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isScalarKey reports whether k may be used as a key by writeReflectedMap.
+func isScalarKey(k reflect.Value) bool {
+	if k.Kind() == reflect.Interface {
+		k = k.Elem()
+	}
+	switch k.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// intKey splits an integer key into sign and CBOR argument.
+func intKey(k reflect.Value) (bool, uint64) {
+	switch k.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return false, k.Uint()
+	}
+	if i := k.Int(); i < 0 {
+		return true, uint64(-1 - i)
+	}
+	return false, uint64(k.Int())
+}
+
+// lessMapKey orders two map keys. Deterministic encoding modes order keys by
+// their encoding. Otherwise keys are ordered by value if they are of the same
+// kind, and by encoding if they are not, as in maps with interface keys.
+func (w *CBORWriter) lessMapKey(a, b mapEntry) bool {
+	switch w.encodingMode {
+	case EncodingModeCoreDeterministic:
+		return bytes.Compare(a.encoded, b.encoded) < 0
+	case EncodingModeLengthFirst:
+		if len(a.encoded) != len(b.encoded) {
+			return len(a.encoded) < len(b.encoded)
+		}
+		return bytes.Compare(a.encoded, b.encoded) < 0
+	}
+
+	ka, kb := a.key, b.key
+	if ka.Kind() == reflect.Interface {
+		ka, kb = ka.Elem(), kb.Elem()
+	}
+	switch {
+	case ka.Kind() == reflect.String && kb.Kind() == reflect.String:
+		return ka.String() < kb.String()
+	case (ka.Kind() == reflect.Float32 || ka.Kind() == reflect.Float64) &&
+		(kb.Kind() == reflect.Float32 || kb.Kind() == reflect.Float64):
+		return ka.Float() < kb.Float()
+	case ka.Kind() == reflect.Bool && kb.Kind() == reflect.Bool:
+		return !ka.Bool() && kb.Bool()
+	case ka.Kind() >= reflect.Int && ka.Kind() <= reflect.Uint64 &&
+		kb.Kind() >= reflect.Int && kb.Kind() <= reflect.Uint64:
+		na, ua := intKey(ka)
+		nb, ub := intKey(kb)
+		if na != nb {
+			return na
+		}
+		if na {
+			return ua > ub
+		}
+		return ua < ub
+	}
+	return bytes.Compare(a.encoded, b.encoded) < 0
+}
+
+// subWriter returns a writer with the same configuration as w writing to out.
+func (w *CBORWriter) subWriter(out io.Writer) *CBORWriter {
+	sw := *w
+	sw.out = out
+	sw.stack = nil
+	sw.selfDescribe = false
+	return &sw
+}
+
+// writeEncodedItem writes an already encoded item, which counts as a single
+// item for the purpose of nesting.
+func (w *CBORWriter) writeEncodedItem(b []byte) error {
+	if err := w.startItem(majorOther, 0, false); err != nil {
+		return err
+	}
+
+	_, err := w.out.Write(b)
+	return err
+}
+
+// isNaNKey returns true if a map key is a floating point NaN, which has no
+// well-defined place in the key order.
+func isNaNKey(k reflect.Value) bool {
+	if k.Kind() == reflect.Interface {
+		k = k.Elem()
+	}
+	switch k.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return math.IsNaN(k.Float())
+	}
+	return false
+}
+
+// writeReflectedMap writes an arbitrary map. Keys must be scalars other than
+// NaN, and are written in a well-defined order so that the output is
+// deterministic.
+func (w *CBORWriter) writeReflectedMap(v reflect.Value) error {
+	entries := make([]mapEntry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k := iter.Key()
+		if !isScalarKey(k) {
+			return fmt.Errorf("Cannot marshal map keys of type %v to CBOR", k.Type())
+		}
+		if isNaNKey(k) {
+			return fmt.Errorf("Cannot marshal NaN map keys to CBOR")
+		}
+		e, err := w.newMapEntry(k, iter.Value().Interface())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	return w.writeMapEntries(entries)
+}
+
+// writeReflectedStruct writes a struct. tagged is true if Marshal has already
+// written a registered tag for it.
+func (w *CBORWriter) writeReflectedStruct(v reflect.Value, tagged bool) error {
 	// retrieve or cache structure specification
 	var scs *structCBORSpec
 	scs, ok := w.scsCache[v.Type()]
 	if !ok {
 		scs = new(structCBORSpec)
-		scs.learnStruct(v.Type())
+		if err := scs.learnStruct(v.Type()); err != nil {
+			return fmt.Errorf("failed to learn struct: %v", err)
+		}
 		w.scsCache[v.Type()] = scs
 	}
 
+	// write the tag of a self-tagging struct, unless Marshal has already
+	// written a tag registered for this type
+	if scs.hasTag && !tagged {
+		if err := w.WriteTag(CBORTag(scs.tag)); err != nil {
+			return err
+		}
+	}
+
 	// and write either an int map or a string map
 	if scs.usingIntKeys() {
 		imap, err := scs.convertStructToIntMap(v)
@@ -2,6 +2,11 @@ package borat_test
 
 import (
 	"bytes"
+	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,7 +32,16 @@ func TestWriteIntegers(t *testing.T) {
 		{0, []byte{0x00}},
 		{1, []byte{0x01}},
 		{-1, []byte{0x20}},
+		{23, []byte{0x17}},
+		{24, []byte{0x18, 0x18}},
 		{33, []byte{0x18, 0x21}},
+		{255, []byte{0x18, 0xff}},
+		{256, []byte{0x19, 0x01, 0x00}},
+		{-256, []byte{0x38, 0xff}},
+		{65535, []byte{0x19, 0xff, 0xff}},
+		{65536, []byte{0x1a, 0x00, 0x01, 0x00, 0x00}},
+		{4294967295, []byte{0x1a, 0xff, 0xff, 0xff, 0xff}},
+		{4294967296, []byte{0x1b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}},
 		{444, []byte{0x19, 0x01, 0xbc}},
 		{-6666, []byte{0x39, 0x1a, 0x09}},
 		{99999, []byte{0x1a, 0x00, 0x01, 0x86, 0x9f}},
@@ -43,6 +57,131 @@ func TestWriteIntegers(t *testing.T) {
 	}
 }
 
+func TestWriteBigInts(t *testing.T) {
+	bigInt := func(s string) *big.Int {
+		b, _ := new(big.Int).SetString(s, 0)
+		return b
+	}
+	testPatterns := []struct {
+		value *big.Int
+		cbor  []byte
+	}{
+		{big.NewInt(0), []byte{0x00}},
+		{big.NewInt(-1), []byte{0x20}},
+		{big.NewInt(1000), []byte{0x19, 0x03, 0xe8}},
+		{bigInt("18446744073709551615"), []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{bigInt("18446744073709551616"), []byte{0xc2, 0x49, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{bigInt("-18446744073709551616"), []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{bigInt("-18446744073709551617"), []byte{0xc3, 0x49, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+
+	for i := range testPatterns {
+		m := func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.WriteBigInt(in.(*big.Int))
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].cbor, m)
+
+		m = func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.Marshal(in)
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].cbor, m)
+	}
+}
+
+func TestWriteDecimals(t *testing.T) {
+	// examples from RFC 8949 section 3.4.4
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	w.WriteDecimal(borat.Decimal{Mantissa: big.NewInt(27315), Exponent: -2})
+	expected := []byte{0xc4, 0x82, 0x21, 0x19, 0x6a, 0xb3}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("error writing decimal: expected [% X], got [% X]", expected, buf.Bytes())
+	}
+
+	buf.Reset()
+	w.WriteBigFloat(big.NewFloat(1.5))
+	expected = []byte{0xc5, 0x82, 0x20, 0x03}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("error writing bigfloat: expected [% X], got [% X]", expected, buf.Bytes())
+	}
+
+	buf.Reset()
+	w.Marshal(big.NewFloat(-0.75))
+	expected = []byte{0xc5, 0x82, 0x21, 0x22}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("error marshaling bigfloat: expected [% X], got [% X]", expected, buf.Bytes())
+	}
+}
+
+func TestWriteNetworkAddresses(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("192.0.2.0/24")
+	testPatterns := []struct {
+		value interface{}
+		cbor  []byte
+	}{
+		{net.ParseIP("192.0.2.1"), []byte{0xd8, 0x34, 0x44, 0xc0, 0x00, 0x02, 0x01}},
+		{netip.MustParseAddr("2001:db8::1"), []byte{0xd8, 0x36, 0x50, 0x20, 0x01, 0x0d, 0xb8,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{ipnet, []byte{0xd8, 0x34, 0x82, 0x18, 0x18, 0x43, 0xc0, 0x00, 0x02}},
+		{netip.MustParsePrefix("2001:db8:1234::/48"), []byte{0xd8, 0x36, 0x82, 0x18, 0x30, 0x46, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34}},
+		{netip.MustParsePrefix("10.0.0.0/8"), []byte{0xd8, 0x34, 0x82, 0x08, 0x41, 0x0a}},
+		{netip.MustParsePrefix("0.0.0.0/0"), []byte{0xd8, 0x34, 0x82, 0x00, 0x40}},
+		{netip.MustParsePrefix("192.0.2.1/24"), []byte{0xd8, 0x34, 0x82, 0x44, 0xc0, 0x00, 0x02, 0x01, 0x18, 0x18}},
+	}
+
+	for i := range testPatterns {
+		m := func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.Marshal(in)
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].cbor, m)
+	}
+}
+
+func TestWriteFloats(t *testing.T) {
+	testPatterns := []struct {
+		value    float64
+		shortest []byte
+		double   []byte
+	}{
+		{0.0, []byte{0xf9, 0x00, 0x00}, []byte{0xfb, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{math.Copysign(0, -1), []byte{0xf9, 0x80, 0x00}, []byte{0xfb, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{1.0, []byte{0xf9, 0x3c, 0x00}, []byte{0xfb, 0x3f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{1.1, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{1.5, []byte{0xf9, 0x3e, 0x00}, []byte{0xfb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{65504.0, []byte{0xf9, 0x7b, 0xff}, nil},
+		{100000.0, []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, nil},
+		{3.4028234663852886e+38, []byte{0xfa, 0x7f, 0x7f, 0xff, 0xff}, nil},
+		{1.0e+300, []byte{0xfb, 0x7e, 0x37, 0xe4, 0x3c, 0x88, 0x00, 0x75, 0x9c}, nil},
+		{5.960464477539063e-08, []byte{0xf9, 0x00, 0x01}, nil},
+		{6.103515625e-05, []byte{0xf9, 0x04, 0x00}, nil},
+		{-4.0, []byte{0xf9, 0xc4, 0x00}, nil},
+		{-4.1, []byte{0xfb, 0xc0, 0x10, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66}, nil},
+		{math.Inf(1), []byte{0xf9, 0x7c, 0x00}, nil},
+		{math.Inf(-1), []byte{0xf9, 0xfc, 0x00}, nil},
+		{math.NaN(), []byte{0xf9, 0x7e, 0x00}, nil},
+	}
+
+	for i := range testPatterns {
+		m := func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.SetFloatPref(borat.FloatPrefShortest)
+			w.WriteFloat(in.(float64))
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].shortest, m)
+		if testPatterns[i].double == nil {
+			continue
+		}
+		m = func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.WriteFloat(in.(float64))
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].double, m)
+	}
+}
+
 func TestWriteStrings(t *testing.T) {
 	testPatterns := []struct {
 		value string
@@ -161,6 +300,355 @@ func TestWriteStringMap(t *testing.T) {
 	}
 }
 
+func TestWriteIndefinite(t *testing.T) {
+	testPatterns := []struct {
+		write func(w *borat.CBORWriter) error
+		cbor  []byte
+	}{
+		{
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginBytes(); err != nil {
+					return err
+				}
+				if err := w.WriteBytes([]byte{0x01, 0x02}); err != nil {
+					return err
+				}
+				if err := w.WriteBytes([]byte{0x03, 0x04, 0x05}); err != nil {
+					return err
+				}
+				return w.End()
+			},
+			[]byte{0x5f, 0x42, 0x01, 0x02, 0x43, 0x03, 0x04, 0x05, 0xff},
+		},
+		{
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginString(); err != nil {
+					return err
+				}
+				if err := w.WriteString("strea"); err != nil {
+					return err
+				}
+				if err := w.WriteString("ming"); err != nil {
+					return err
+				}
+				return w.End()
+			},
+			[]byte{0x7f, 0x65, 0x73, 0x74, 0x72, 0x65, 0x61, 0x64, 0x6d, 0x69, 0x6e, 0x67, 0xff},
+		},
+		{
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginArray(); err != nil {
+					return err
+				}
+				if err := w.WriteInt(1); err != nil {
+					return err
+				}
+				if err := w.WriteIntArray([]int{2, 3}); err != nil {
+					return err
+				}
+				if err := w.BeginArray(); err != nil {
+					return err
+				}
+				if err := w.WriteInt(4); err != nil {
+					return err
+				}
+				if err := w.WriteInt(5); err != nil {
+					return err
+				}
+				if err := w.End(); err != nil {
+					return err
+				}
+				return w.End()
+			},
+			[]byte{0x9f, 0x01, 0x82, 0x02, 0x03, 0x9f, 0x04, 0x05, 0xff, 0xff},
+		},
+		{
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginMap(); err != nil {
+					return err
+				}
+				if err := w.WriteString("a"); err != nil {
+					return err
+				}
+				if err := w.WriteInt(1); err != nil {
+					return err
+				}
+				if err := w.WriteString("b"); err != nil {
+					return err
+				}
+				if err := w.BeginArray(); err != nil {
+					return err
+				}
+				if err := w.WriteInt(2); err != nil {
+					return err
+				}
+				if err := w.WriteInt(3); err != nil {
+					return err
+				}
+				if err := w.End(); err != nil {
+					return err
+				}
+				return w.End()
+			},
+			[]byte{0xbf, 0x61, 0x61, 0x01, 0x61, 0x62, 0x9f, 0x02, 0x03, 0xff, 0xff},
+		},
+	}
+
+	for i := range testPatterns {
+		var buf bytes.Buffer
+		w := borat.NewCBORWriter(&buf)
+		if err := testPatterns[i].write(w); err != nil {
+			t.Errorf("pattern %d: unexpected error: %v", i, err)
+			continue
+		}
+		if err := w.Finish(); err != nil {
+			t.Errorf("pattern %d: unexpected error from Finish: %v", i, err)
+		}
+		if bytes.Compare(buf.Bytes(), testPatterns[i].cbor) != 0 {
+			t.Errorf("pattern %d: expected [% X], got [% X]", i, testPatterns[i].cbor, buf.Bytes())
+		}
+	}
+}
+
+func TestWriteIndefiniteMisplaced(t *testing.T) {
+	testPatterns := []struct {
+		name  string
+		write func(w *borat.CBORWriter) error
+	}{
+		{
+			"end without begin",
+			func(w *borat.CBORWriter) error {
+				return w.End()
+			},
+		},
+		{
+			"string chunk in byte string",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginBytes(); err != nil {
+					return err
+				}
+				return w.WriteString("a")
+			},
+		},
+		{
+			"nested indefinite chunk",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginString(); err != nil {
+					return err
+				}
+				return w.BeginString()
+			},
+		},
+		{
+			"array in string",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginString(); err != nil {
+					return err
+				}
+				return w.BeginArray()
+			},
+		},
+		{
+			"map key without value",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginMap(); err != nil {
+					return err
+				}
+				if err := w.WriteString("a"); err != nil {
+					return err
+				}
+				return w.End()
+			},
+		},
+		{
+			"end after tag",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginArray(); err != nil {
+					return err
+				}
+				if err := w.WriteTag(borat.TagURI); err != nil {
+					return err
+				}
+				return w.End()
+			},
+		},
+		{
+			"end twice",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginArray(); err != nil {
+					return err
+				}
+				if err := w.End(); err != nil {
+					return err
+				}
+				return w.End()
+			},
+		},
+		{
+			"begin without end",
+			func(w *borat.CBORWriter) error {
+				if err := w.BeginArray(); err != nil {
+					return err
+				}
+				if err := w.WriteInt(1); err != nil {
+					return err
+				}
+				return w.Finish()
+			},
+		},
+	}
+
+	for _, p := range testPatterns {
+		var buf bytes.Buffer
+		w := borat.NewCBORWriter(&buf)
+		if err := p.write(w); err == nil {
+			t.Errorf("%s: expected an error but got none", p.name)
+		}
+	}
+}
+
+func TestMarshalMaps(t *testing.T) {
+	testPatterns := []struct {
+		value interface{}
+		cbor  []byte
+	}{
+		{
+			map[string]int{"b": 2, "a": 1, "aa": 3},
+			[]byte{0xa3, 0x61, 0x61, 0x01, 0x62, 0x61, 0x61, 0x03, 0x61, 0x62, 0x02},
+		},
+		{
+			map[int]string{10: "c", -1: "a", 2: "b"},
+			[]byte{0xa3, 0x20, 0x61, 0x61, 0x02, 0x61, 0x62, 0x0a, 0x61, 0x63},
+		},
+		{
+			map[uint64]bool{1000: true, 1: false},
+			[]byte{0xa2, 0x01, 0xf4, 0x19, 0x03, 0xe8, 0xf5},
+		},
+		{
+			map[interface{}]int{"a": 1, 2: 2},
+			[]byte{0xa2, 0x02, 0x02, 0x61, 0x61, 0x01},
+		},
+		{
+			map[string]interface{}{"Zürich": "CH", "Seattle, WA": "USA"},
+			[]byte{
+				0xA2, 0x6B, 0x53, 0x65, 0x61, 0x74, 0x74, 0x6C,
+				0x65, 0x2C, 0x20, 0x57, 0x41, 0x63, 0x55, 0x53,
+				0x41, 0x67, 0x5A, 0xC3, 0xBC, 0x72, 0x69, 0x63,
+				0x68, 0x62, 0x43, 0x48,
+			},
+		},
+	}
+
+	for i := range testPatterns {
+		m := func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			if err := w.Marshal(in); err != nil {
+				t.Errorf("Marshal failed: %v", err)
+			}
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].cbor, m)
+	}
+}
+
+func TestDeterministicEncoding(t *testing.T) {
+	testPatterns := []struct {
+		value       interface{}
+		core        []byte
+		lengthFirst []byte
+	}{
+		{
+			map[string]interface{}{
+				"Zürich":      "CH",
+				"Seattle, WA": "USA",
+			},
+			[]byte{
+				0xA2, 0x67, 0x5A, 0xC3, 0xBC, 0x72, 0x69, 0x63,
+				0x68, 0x62, 0x43, 0x48, 0x6B, 0x53, 0x65, 0x61,
+				0x74, 0x74, 0x6C, 0x65, 0x2C, 0x20, 0x57, 0x41,
+				0x63, 0x55, 0x53, 0x41,
+			},
+			[]byte{
+				0xA2, 0x67, 0x5A, 0xC3, 0xBC, 0x72, 0x69, 0x63,
+				0x68, 0x62, 0x43, 0x48, 0x6B, 0x53, 0x65, 0x61,
+				0x74, 0x74, 0x6C, 0x65, 0x2C, 0x20, 0x57, 0x41,
+				0x63, 0x55, 0x53, 0x41,
+			},
+		},
+		{
+			map[int]interface{}{10: 1, 100: 2, -1: 3},
+			[]byte{0xa3, 0x0a, 0x01, 0x18, 0x64, 0x02, 0x20, 0x03},
+			[]byte{0xa3, 0x0a, 0x01, 0x20, 0x03, 0x18, 0x64, 0x02},
+		},
+		{
+			map[string]int{"aa": 1, "b": 2},
+			[]byte{0xa2, 0x61, 0x62, 0x02, 0x62, 0x61, 0x61, 0x01},
+			[]byte{0xa2, 0x61, 0x62, 0x02, 0x62, 0x61, 0x61, 0x01},
+		},
+		{
+			map[interface{}]int{"z": 1, 256: 2, false: 3},
+			[]byte{0xa3, 0x19, 0x01, 0x00, 0x02, 0x61, 0x7a, 0x01, 0xf4, 0x03},
+			[]byte{0xa3, 0xf4, 0x03, 0x61, 0x7a, 0x01, 0x19, 0x01, 0x00, 0x02},
+		},
+		{
+			stringTaggedTestStruct{7171, "spåm", true},
+			[]byte{
+				0xa3, 0x65, 0x74, 0x72, 0x75, 0x74, 0x68, 0xf5,
+				0x66, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x19,
+				0x1c, 0x03, 0x66, 0x73, 0x74, 0x72, 0x69, 0x6e,
+				0x67, 0x65, 0x73, 0x70, 0xc3, 0xa5, 0x6d,
+			},
+			[]byte{
+				0xa3, 0x65, 0x74, 0x72, 0x75, 0x74, 0x68, 0xf5,
+				0x66, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x19,
+				0x1c, 0x03, 0x66, 0x73, 0x74, 0x72, 0x69, 0x6e,
+				0x67, 0x65, 0x73, 0x70, 0xc3, 0xa5, 0x6d,
+			},
+		},
+		{
+			[]interface{}{1.5, 100000.0, 1.1},
+			[]byte{
+				0x83, 0xf9, 0x3e, 0x00, 0xfa, 0x47, 0xc3, 0x50,
+				0x00, 0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99,
+				0x99, 0x9a,
+			},
+			[]byte{
+				0x83, 0xf9, 0x3e, 0x00, 0xfa, 0x47, 0xc3, 0x50,
+				0x00, 0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99,
+				0x99, 0x9a,
+			},
+		},
+	}
+
+	for i := range testPatterns {
+		m := func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.SetEncodingMode(borat.EncodingModeCoreDeterministic)
+			if err := w.Marshal(in); err != nil {
+				t.Errorf("Marshal failed: %v", err)
+			}
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].core, m)
+		m = func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.SetEncodingMode(borat.EncodingModeLengthFirst)
+			if err := w.Marshal(in); err != nil {
+				t.Errorf("Marshal failed: %v", err)
+			}
+		}
+		cborTestHarness(t, testPatterns[i].value, testPatterns[i].lengthFirst, m)
+	}
+
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	w.SetEncodingMode(borat.EncodingModeCoreDeterministic)
+	if err := w.BeginArray(); err == nil {
+		t.Errorf("expected an error writing an indefinite-length array in deterministic mode")
+	}
+	if err := w.Marshal(map[interface{}]int{1: 1, uint(1): 2}); err == nil {
+		t.Errorf("expected an error writing duplicate map keys in deterministic mode")
+	}
+}
+
 func TestTime(t *testing.T) {
 	testPatterns := []struct {
 		value time.Time
@@ -180,7 +668,6 @@ func TestTime(t *testing.T) {
 		},
 	}
 
-	// TODO: add tests for string based time format.
 	for i := range testPatterns {
 		m := func(in interface{}, out *bytes.Buffer) {
 			w := borat.NewCBORWriter(out)
@@ -188,6 +675,64 @@ func TestTime(t *testing.T) {
 		}
 		cborTestHarness(t, testPatterns[i].value, testPatterns[i].cbor, m)
 	}
+
+	prefPatterns := []struct {
+		pref  borat.DateTimePref
+		value time.Time
+		cbor  []byte
+	}{
+		{
+			borat.DateTimePrefFloat,
+			time.Unix(1363896240, 500000000),
+			[]byte{0xC1, 0xFB, 0x41, 0xD4, 0x52, 0xD9, 0xEC, 0x20, 0x00, 0x00},
+		},
+		{
+			borat.DateTimePrefString,
+			time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC),
+			append([]byte{0xC0, 0x74}, "2013-03-21T20:04:00Z"...),
+		},
+		{
+			borat.DateTimePrefString,
+			time.Date(2013, 3, 21, 20, 4, 0, 123456789, time.FixedZone("", -5*3600)),
+			append([]byte{0xC0, 0x78, 0x23}, "2013-03-21T20:04:00.123456789-05:00"...),
+		},
+	}
+	for i := range prefPatterns {
+		pref := prefPatterns[i].pref
+		m := func(in interface{}, out *bytes.Buffer) {
+			w := borat.NewCBORWriter(out)
+			w.SetDateTimePref(pref)
+			w.WriteTime(in.(time.Time))
+		}
+		cborTestHarness(t, prefPatterns[i].value, prefPatterns[i].cbor, m)
+	}
+
+	// extended time with nanoseconds and a fixed offset
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	w.SetDateTimePref(borat.DateTimePrefExtended)
+	w.WriteTime(time.Unix(1363896240, 5).In(time.FixedZone("", 3600)))
+	expected := []byte{0xd9, 0x03, 0xe9, 0xa3, 0x29, 0x19, 0x0e, 0x10, 0x28, 0x05, 0x01, 0x1a, 0x51, 0x4b, 0x67, 0xb0}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("error writing extended time: expected [% X], got [% X]", expected, buf.Bytes())
+	}
+
+	// dates as days since the epoch or as strings
+	buf.Reset()
+	w = borat.NewCBORWriter(&buf)
+	w.WriteDate(borat.Date{Year: 1969, Month: time.October, Day: 3})
+	w.SetDateTimePref(borat.DateTimePrefString)
+	w.WriteDate(borat.Date{Year: 1940, Month: time.October, Day: 9})
+	expected = append([]byte{0xd8, 0x64, 0x38, 0x59, 0xd9, 0x03, 0xec, 0x6a}, "1940-10-09"...)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("error writing dates: expected [% X], got [% X]", expected, buf.Bytes())
+	}
+
+	w = borat.NewCBORWriter(&bytes.Buffer{})
+	w.SetDateTimePref(borat.DateTimePref(42))
+	if err := w.WriteTime(time.Now()); err == nil {
+		t.Errorf("expected an error for an unknown date time preference")
+	}
 }
 
 type untaggedTestStruct struct {
@@ -258,3 +803,106 @@ func TestWriteStructs(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteSelfDescribe(t *testing.T) {
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	w.SetSelfDescribe(true)
+	w.Marshal(map[string]int{"a": 1})
+	w.WriteInt(2)
+	expected := []byte{0xd9, 0xd9, 0xf7, 0xa1, 0x61, 0x61, 0x01, 0x02}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected [% X], got [% X]", expected, buf.Bytes())
+	}
+	if !borat.IsCBOR(buf.Bytes()) {
+		t.Errorf("expected output to be recognized as CBOR")
+	}
+	if borat.IsCBOR([]byte{0xd9, 0xd9}) || borat.IsCBOR([]byte{0xa1, 0x61, 0x61}) {
+		t.Errorf("expected data without the self-describe tag not to be recognized")
+	}
+}
+
+func TestWriteSimple(t *testing.T) {
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	w.WriteSimple(16)
+	w.WriteUndefined()
+	w.WriteSimple(255)
+	w.Marshal([]interface{}{borat.SimpleValue(32), borat.Undefined})
+	expected := []byte{0xf0, 0xf7, 0xf8, 0xff, 0x82, 0xf8, 0x20, 0xf7}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected [% X], got [% X]", expected, buf.Bytes())
+	}
+	for _, v := range []borat.SimpleValue{24, 31} {
+		if err := w.WriteSimple(v); err == nil {
+			t.Errorf("expected error writing reserved simple value %d", v)
+		}
+	}
+}
+
+func TestWriteNil(t *testing.T) {
+	type optional struct {
+		P *int
+		I interface{}
+		S []int
+	}
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	for _, v := range []interface{}{nil, (*int)(nil), []int(nil), map[string]int(nil), (*big.Int)(nil),
+		[]interface{}{nil, (*string)(nil)}, optional{}} {
+		if err := w.Marshal(v); err != nil {
+			t.Errorf("Marshal(%#v) failed: %v", v, err)
+		}
+	}
+	expected := []byte{0xf6, 0xf6, 0xf6, 0xf6, 0xf6, 0x82, 0xf6, 0xf6, 0xa1, 0x61, 0x53, 0xf6}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected [% X], got [% X]", expected, buf.Bytes())
+	}
+}
+
+type digest [4]byte
+
+type blob []byte
+
+func TestWriteByteArrays(t *testing.T) {
+	type keyed struct {
+		D digest  `cbor:"d"`
+		A [2]byte `cbor:",array"`
+		B blob    `cbor:"b,array"`
+	}
+	var buf bytes.Buffer
+	w := borat.NewCBORWriter(&buf)
+	for _, v := range []interface{}{[4]byte{0xc, 0xa, 0xf, 0xe}, digest{1, 2, 3, 4}, blob{5},
+		keyed{D: digest{1}, A: [2]byte{2, 3}, B: blob{0x20}}} {
+		if err := w.Marshal(v); err != nil {
+			t.Errorf("Marshal(%#v) failed: %v", v, err)
+		}
+	}
+	expected := []byte{
+		0x44, 0x0c, 0x0a, 0x0f, 0x0e,
+		0x44, 0x01, 0x02, 0x03, 0x04,
+		0x41, 0x05,
+		0xa3, 0x61, 0x41, 0x82, 0x02, 0x03, 0x61, 0x62, 0x81, 0x18, 0x20, 0x61, 0x64, 0x44, 0x01, 0x00, 0x00, 0x00,
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected [% X], got [% X]", expected, buf.Bytes())
+	}
+
+	type badOption struct {
+		A []int `cbor:"a,array"`
+	}
+	type unknownOption struct {
+		A []byte `cbor:"a,omitempty"`
+	}
+	type bogusOption struct {
+		A string `cbor:"a,bogus"`
+	}
+	for _, v := range []interface{}{badOption{}, unknownOption{}, bogusOption{}} {
+		// the struct is not cached after failing, so it fails every time
+		for i := 0; i < 2; i++ {
+			if err := w.Marshal(v); err == nil || !strings.Contains(err.Error(), "option") {
+				t.Errorf("Marshal(%#v): expected error for struct tag option, got %v", v, err)
+			}
+		}
+	}
+}